@@ -0,0 +1,130 @@
+/* Copyright (c) 2016 Chris Smith
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED ``AS IS'' AND ANY EXPRESS OR IMPLIED
+ * WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package unifiedbeat
+
+import (
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/elastic/beats/libbeat/logp"
+)
+
+var ackCounts = expvar.NewMap("unifiedbeatAcks")
+
+// Acker moves a sensor's registry forward only as far as the output
+// has acknowledged every event published before, so after a crash or
+// an output outage the unacknowledged events are read and sent again.
+type Acker struct {
+	sensor   *Sensor
+	pending  []*ackSignal // in the order published
+	inFlight sync.WaitGroup
+	sync.Mutex
+}
+
+// ackSignal is the outputs.Signaler given to libbeat with each event,
+// or each batch of events (see "beat/batch.go").
+type ackSignal struct {
+	acker  *Acker
+	source string
+	offset int64
+	done   bool
+}
+
+func NewAcker(sensor *Sensor) *Acker {
+	return &Acker{sensor: sensor}
+}
+
+// Signal returns the signaler for the events read from "source" up to
+// "offset", they must be published in the order they were read.
+func (a *Acker) Signal(source string, offset int64) *ackSignal {
+	a.Lock()
+	defer a.Unlock()
+	s := &ackSignal{acker: a, source: source, offset: offset}
+	a.pending = append(a.pending, s)
+	a.inFlight.Add(1)
+	return s
+}
+
+// WaitTimeout waits for at most "timeout" for every event published
+// to be acknowledged, it reports whether they all were.
+func (a *Acker) WaitTimeout(timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	return a.wait(nil, timer.C)
+}
+
+// WaitOrStop blocks until every event published has been acknowledged
+// or "stop" is closed, it reports whether they all were.
+func (a *Acker) WaitOrStop(stop <-chan struct{}) bool {
+	return a.wait(stop, nil)
+}
+
+func (a *Acker) wait(stop <-chan struct{}, timeout <-chan time.Time) bool {
+	acked := make(chan struct{})
+	go func() {
+		a.inFlight.Wait()
+		close(acked)
+	}()
+	select {
+	case <-acked:
+		return true
+	case <-stop:
+		return false
+	case <-timeout:
+		return false
+	}
+}
+
+// Completed moves the registry to the last of the signals, in the order
+// published, acknowledged so far. The registry is updated while still
+// locked, so concurrent acknowledgements can't move it backwards.
+func (s *ackSignal) Completed() {
+	a := s.acker
+	a.Lock()
+	s.done = true
+	var last *ackSignal
+	for len(a.pending) > 0 && a.pending[0].done {
+		last = a.pending[0]
+		a.pending = a.pending[1:]
+	}
+	if last != nil {
+		a.sensor.registrar.Update(last.source, last.offset)
+	}
+	a.Unlock()
+	ackCounts.Add("completed", 1)
+	a.inFlight.Done()
+}
+
+// Failed only happens when libbeat gives up on an event, which with
+// publisher.Guaranteed is when it is shutting down, so the registry
+// is left behind this event and it is sent again after a restart.
+func (s *ackSignal) Failed() {
+	logp.Warn("Acker: %v event from '%v' at offset %v was not acknowledged", s.acker.sensor, s.source, s.offset)
+	ackCounts.Add("failed", 1)
+	s.acker.inFlight.Done()
+}
@@ -0,0 +1,198 @@
+/* Copyright (c) 2016 Chris Smith
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED ``AS IS'' AND ANY EXPRESS OR IMPLIED
+ * WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package unifiedbeat
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testRegistrar is a Registrar writing to a temporary folder, removed
+// by the function returned.
+func testRegistrar(t *testing.T) (*Registrar, func()) {
+	folder, err := ioutil.TempDir("", "unifiedbeat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	registrar, err := NewRegistrar(filepath.Join(folder, "registry"))
+	if err != nil {
+		os.RemoveAll(folder)
+		t.Fatal(err)
+	}
+	return registrar, func() { os.RemoveAll(folder) }
+}
+
+type ackPosition struct {
+	source string
+	offset int64
+}
+
+func TestAckerOrder(t *testing.T) {
+	type ack struct {
+		signal int
+		failed bool
+	}
+	tests := []struct {
+		name     string
+		signals  []ackPosition
+		acks     []ack
+		expected []ackPosition // the registry after each ack
+	}{
+		{
+			"in order",
+			[]ackPosition{{"a", 10}, {"a", 20}, {"a", 30}},
+			[]ack{{0, false}, {1, false}, {2, false}},
+			[]ackPosition{{"a", 10}, {"a", 20}, {"a", 30}},
+		},
+		{
+			"out of order",
+			[]ackPosition{{"a", 10}, {"a", 20}, {"a", 30}},
+			[]ack{{2, false}, {1, false}, {0, false}},
+			[]ackPosition{{"", 0}, {"", 0}, {"a", 30}},
+		},
+		{
+			"the first fails",
+			[]ackPosition{{"a", 10}, {"a", 20}, {"a", 30}},
+			[]ack{{0, true}, {2, false}, {1, false}},
+			[]ackPosition{{"", 0}, {"", 0}, {"", 0}},
+		},
+		{
+			"one in the middle fails",
+			[]ackPosition{{"a", 10}, {"a", 20}, {"a", 30}},
+			[]ack{{0, false}, {2, false}, {1, true}},
+			[]ackPosition{{"a", 10}, {"a", 10}, {"a", 10}},
+		},
+		{
+			"across files",
+			[]ackPosition{{"a", 10}, {"a", 20}, {"b", 5}},
+			[]ack{{2, false}, {0, false}, {1, false}},
+			[]ackPosition{{"", 0}, {"a", 10}, {"b", 5}},
+		},
+	}
+
+	for _, test := range tests {
+		registrar, remove := testRegistrar(t)
+		acker := NewAcker(&Sensor{Name: "test", registrar: registrar})
+		var signals []*ackSignal
+		for _, position := range test.signals {
+			signals = append(signals, acker.Signal(position.source, position.offset))
+		}
+		for i, ack := range test.acks {
+			if ack.failed {
+				signals[ack.signal].Failed()
+			} else {
+				signals[ack.signal].Completed()
+			}
+			state := ackPosition{registrar.State.Source, registrar.State.Offset}
+			if state != test.expected[i] {
+				t.Errorf("%v: after ack %v the registry is at %v, expected %v", test.name, i, state, test.expected[i])
+			}
+		}
+		if !acker.WaitTimeout(time.Second) {
+			t.Errorf("%v: still waiting after every signal was acked", test.name)
+		}
+		remove()
+	}
+}
+
+func TestAckerWaitTimeout(t *testing.T) {
+	registrar, remove := testRegistrar(t)
+	defer remove()
+	acker := NewAcker(&Sensor{Name: "test", registrar: registrar})
+	signal := acker.Signal("a", 10)
+	if acker.WaitTimeout(10 * time.Millisecond) {
+		t.Error("WaitTimeout returned true with a signal pending")
+	}
+	stop := make(chan struct{})
+	close(stop)
+	if acker.WaitOrStop(stop) {
+		t.Error("WaitOrStop returned true with a signal pending")
+	}
+	signal.Completed()
+	if !acker.WaitTimeout(time.Second) {
+		t.Error("WaitTimeout returned false with no signal pending")
+	}
+}
+
+// Acks completed concurrently, in any order, never move the registry
+// backwards and it ends at the last signal.
+func TestAckerConcurrent(t *testing.T) {
+	registrar, remove := testRegistrar(t)
+	defer remove()
+	acker := NewAcker(&Sensor{Name: "test", registrar: registrar})
+
+	const count = 1000
+	var signals []*ackSignal
+	for i := 1; i <= count; i++ {
+		signals = append(signals, acker.Signal("a", int64(i)))
+	}
+
+	done := make(chan struct{})
+	backwards := make(chan int64, 1)
+	go func() {
+		var last int64
+		for {
+			select {
+			case <-done:
+				close(backwards)
+				return
+			default:
+			}
+			registrar.Lock()
+			offset := registrar.State.Offset
+			registrar.Unlock()
+			if offset < last {
+				backwards <- offset
+				close(backwards)
+				return
+			}
+			last = offset
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for _, i := range rand.Perm(count) {
+		wg.Add(1)
+		go func(signal *ackSignal) {
+			defer wg.Done()
+			signal.Completed()
+		}(signals[i])
+	}
+	wg.Wait()
+	close(done)
+	if offset, ok := <-backwards; ok {
+		t.Errorf("the registry moved backwards to %v", offset)
+	}
+	if registrar.State.Offset != count {
+		t.Errorf("the registry is at %v, expected %v", registrar.State.Offset, count)
+	}
+}
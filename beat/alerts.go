@@ -0,0 +1,274 @@
+/* Copyright (c) 2016 Chris Smith
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED ``AS IS'' AND ANY EXPRESS OR IMPLIED
+ * WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package unifiedbeat
+
+import (
+	"expvar"
+	"time"
+
+	"github.com/cleesmith/go-unified2"
+	"github.com/elastic/beats/libbeat/common"
+)
+
+// Counts of alert documents, see the expvar web interface (-httpprof).
+var alertCounts = expvar.NewMap("unifiedbeatAlerts")
+
+type AlertsConfig struct {
+	// publish one "alert" document per event instead of a
+	// document per event, packet and extradata record
+	Enabled bool
+	// milliseconds an alert waits for more of its records
+	Timeout int
+	// alerts waiting for more records, beyond this the oldest is published
+	MaxPending int `yaml:"max_pending"`
+}
+
+// an eventAdder takes the document of a record read from "source" up
+// to "offset", such as a Batch
+type eventAdder interface {
+	Add(event common.MapStr, source string, offset int64)
+}
+
+// addFunc is an eventAdder function
+type addFunc func(event common.MapStr, source string, offset int64)
+
+func (f addFunc) Add(event common.MapStr, source string, offset int64) {
+	f(event, source, offset)
+}
+
+// alertKey links an event to its packet and extradata records
+type alertKey struct {
+	sensorId, eventId, eventSecond uint32
+}
+
+// alert is an event, with its packets and extradata, being collected.
+type alert struct {
+	key       alertKey
+	event     common.MapStr // nil until the event record is read
+	shared    common.MapStr // the shared fields of the first record
+	packets   []common.MapStr
+	extradata []common.MapStr
+	start     int64 // where its first record starts
+	offset    int64 // end of its last record
+	source    string
+	started   time.Time
+}
+
+// Alerts sits between a sensor's Pipeline and its Batch (or Backfill
+// and its batch), merging the
+// documents of an event, its packets and extradata into one "alert"
+// document.  Snort writes those records one after the other, so an
+// alert is published when the next event is read, when it has waited
+// "timeout" for more records, or when there are more than "maxPending"
+// alerts waiting.  Other documents are passed on as they are.
+//
+// The registry must not move past a record whose alert is still
+// waiting, so a document passed on meanwhile carries the start of the
+// oldest waiting alert as its offset.
+type Alerts struct {
+	batch      eventAdder
+	timeout    time.Duration
+	maxPending int
+	shared     []string // fields of the alert itself, not of each record
+	pending    []*alert // in the order read
+	byKey      map[alertKey]*alert
+	source     string // file of the last record added
+	previous   int64  // end of the last record added
+}
+
+func NewAlerts(batch eventAdder, config AlertsConfig, fields map[string]string, fieldsUnderRoot bool) *Alerts {
+	a := &Alerts{
+		batch:      batch,
+		timeout:    time.Duration(config.Timeout) * time.Millisecond,
+		maxPending: config.MaxPending,
+		byKey:      make(map[alertKey]*alert),
+		shared: []string{"indexed_at", "source", "source_offset", "input_type", "type", "record_type",
+			"sensor_id", "event_id", "event_second", "fields", "@metadata"},
+	}
+	if a.timeout <= 0 {
+		a.timeout = 2 * time.Second
+	}
+	if a.maxPending <= 0 {
+		a.maxPending = 1000
+	}
+	if fieldsUnderRoot {
+		for key := range fields {
+			a.shared = append(a.shared, key)
+		}
+	}
+	return a
+}
+
+// Add takes the document of a record read from "source" up to "offset".
+func (a *Alerts) Add(record interface{}, event common.MapStr, source string, offset int64) {
+	// a record starts where the one before it ended, the start of the
+	// first record read from a file is not known, but 0 is safe:
+	start := a.previous
+	if source != a.source {
+		start = 0
+	}
+	a.source = source
+	a.previous = offset
+
+	var key alertKey
+	isEvent := false
+	switch r := record.(type) {
+	case *unified2.EventRecord:
+		key, isEvent = alertKey{r.SensorId, r.EventId, r.EventSecond}, true
+	case *unified2.AppIdEventRecord:
+		key, isEvent = alertKey{r.SensorId, r.EventId, r.EventSecond}, true
+	case *unified2.PacketRecord:
+		key = alertKey{r.SensorId, r.EventId, r.EventSecond}
+	case *unified2.ExtraDataRecord:
+		key = alertKey{r.SensorId, r.EventId, r.EventSecond}
+	default:
+		a.batch.Add(event, source, a.checkpoint(offset))
+		return
+	}
+
+	current, found := a.byKey[key]
+	if found && isEvent && current.event != nil {
+		// the same event again, so the first is complete
+		a.publish(current)
+		found = false
+	}
+	if !found {
+		if isEvent {
+			// Snort writes an event's records before the next event
+			a.publishBefore(start)
+		}
+		current = &alert{key: key, shared: common.MapStr{}, start: start, source: source, started: time.Now()}
+		for _, field := range a.shared {
+			if value, ok := event[field]; ok {
+				current.shared[field] = value
+			}
+		}
+		a.pending = append(a.pending, current)
+		a.byKey[key] = current
+		if len(a.pending) > a.maxPending {
+			alertCounts.Add("evicted", 1)
+			a.publish(a.pending[0])
+		}
+	}
+	current.offset = offset
+	switch record.(type) {
+	case *unified2.PacketRecord:
+		current.packets = append(current.packets, a.strip(event))
+	case *unified2.ExtraDataRecord:
+		current.extradata = append(current.extradata, a.strip(event))
+	default:
+		current.event = event
+	}
+}
+
+// publishBefore publishes the alerts that started before "offset" and
+// have an event, as the records of a new event follow them.
+func (a *Alerts) publishBefore(offset int64) {
+	for len(a.pending) > 0 && a.pending[0].event != nil && a.pending[0].start < offset {
+		a.publish(a.pending[0])
+	}
+}
+
+// FlushIfDue publishes the alerts that have waited too long.
+func (a *Alerts) FlushIfDue() {
+	for len(a.pending) > 0 && time.Since(a.pending[0].started) >= a.timeout {
+		alertCounts.Add("timed", 1)
+		a.publish(a.pending[0])
+	}
+}
+
+// untilDue is how long until an alert must be published, at most "max".
+func (a *Alerts) untilDue(max time.Duration) time.Duration {
+	if len(a.pending) == 0 {
+		return max
+	}
+	due := a.timeout - time.Since(a.pending[0].started)
+	if due < 0 {
+		return 0
+	}
+	if due < max {
+		return due
+	}
+	return max
+}
+
+// Flush publishes every alert, e.g. before a file is closed.
+func (a *Alerts) Flush() {
+	for len(a.pending) > 0 {
+		a.publish(a.pending[0])
+	}
+}
+
+// publish adds the alert's document to the Batch.
+func (a *Alerts) publish(current *alert) {
+	for i, pending := range a.pending {
+		if pending == current {
+			a.pending = append(a.pending[:i], a.pending[i+1:]...)
+			break
+		}
+	}
+	delete(a.byKey, current.key)
+
+	document := current.event
+	if document == nil {
+		// packets or extradata without their event
+		document = current.shared
+		document["@timestamp"] = common.Time(time.Unix(int64(current.key.eventSecond), 0))
+		alertCounts.Add("without_event", 1)
+	}
+	document["type"] = "alert"
+	document["record_type"] = "alert"
+	document["source_offset"] = current.offset
+	document["packet_count"] = len(current.packets)
+	if len(current.packets) > 0 {
+		document["packets"] = current.packets
+	}
+	if len(current.extradata) > 0 {
+		document["extradata"] = current.extradata
+	}
+	alertCounts.Add("published", 1)
+	a.batch.Add(document, current.source, a.checkpoint(current.offset))
+}
+
+// checkpoint is how far the registry may move once a document that
+// ends at "offset" is acknowledged: no further than the start of the
+// oldest alert still waiting.
+func (a *Alerts) checkpoint(offset int64) int64 {
+	if len(a.pending) > 0 && a.pending[0].start < offset {
+		return a.pending[0].start
+	}
+	return offset
+}
+
+// strip removes the fields an alert document holds once for all of
+// its records.
+func (a *Alerts) strip(event common.MapStr) common.MapStr {
+	for _, key := range a.shared {
+		delete(event, key)
+	}
+	return event
+}
@@ -0,0 +1,295 @@
+/* Copyright (c) 2016 Chris Smith
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED ``AS IS'' AND ANY EXPRESS OR IMPLIED
+ * WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package unifiedbeat
+
+import (
+	"compress/gzip"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/elastic/beats/libbeat/logp"
+)
+
+// Counts of archive actions, see the expvar web interface (-httpprof).
+var archiveCounts = expvar.NewMap("unifiedbeatArchive")
+
+// archivedPrefix starts the name of every archived unified2 file, so
+// they no longer match the spool prefix and are never read again.
+const archivedPrefix = "indexed_"
+
+type ArchiveConfig struct {
+	// rename (the default), move, gzip or delete
+	Action    string
+	Folder    string
+	KeepFiles int `yaml:"keep_files"`
+	KeepDays  int `yaml:"keep_days"`
+	MaxDiskMB int `yaml:"max_disk_mb"`
+}
+
+// Archiver is handed each unified2 file once it has been fully indexed.
+type Archiver interface {
+	Archive(file string)
+
+	// Prune removes archived files beyond the keep_files,
+	// keep_days and max_disk_mb limits.
+	Prune()
+
+	// Folder is where archived files are, the spool folder unless
+	// they are moved or compressed elsewhere.
+	Folder() string
+}
+
+// NewArchiver returns the Archiver for the "archive:" settings of a
+// sensor. The archive folder defaults to the spool folder.
+func NewArchiver(config ArchiveConfig, spoolFolder, spoolPrefix string) (Archiver, error) {
+	folder := config.Folder
+	if folder == "" {
+		folder = spoolFolder
+	}
+	folder, err := filepath.Abs(folder)
+	if err != nil {
+		return nil, err
+	}
+
+	var archive func(string) (string, error)
+	switch config.Action {
+	case "", "rename":
+		if folder != spoolFolder {
+			return nil, fmt.Errorf("archive 'folder' is only used by the move and gzip actions")
+		}
+		archive = func(file string) (string, error) {
+			return archiveRename(file, folder)
+		}
+	case "move":
+		archive = func(file string) (string, error) {
+			return archiveRename(file, folder)
+		}
+	case "gzip":
+		archive = func(file string) (string, error) {
+			return archiveGzip(file, folder)
+		}
+	case "delete":
+		archive = func(file string) (string, error) {
+			return "", os.Remove(file)
+		}
+	default:
+		return nil, fmt.Errorf("unknown archive action: '%v'", config.Action)
+	}
+
+	if folder != spoolFolder {
+		info, err := os.Stat(folder)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			return nil, fmt.Errorf("archive folder is not a folder: '%v'", folder)
+		}
+	}
+
+	a := &archiver{
+		action:  config.Action,
+		archive: archive,
+		folder:  folder,
+		prefix:  spoolPrefix,
+		keep:    config.KeepFiles,
+		maxAge:  time.Duration(config.KeepDays) * 24 * time.Hour,
+		maxDisk: int64(config.MaxDiskMB) * 1024 * 1024,
+	}
+	if a.action == "" {
+		a.action = "rename"
+	}
+	return a, nil
+}
+
+type archiver struct {
+	action  string
+	archive func(string) (string, error)
+	folder  string
+	prefix  string
+	keep    int
+	maxAge  time.Duration
+	maxDisk int64
+}
+
+func (a *archiver) Archive(file string) {
+	archived, err := a.archive(file)
+	if err != nil {
+		archiveCounts.Add("errors", 1)
+		logp.Info("Archive: unable to %v file '%v' err: %v", a.action, file, err)
+		return
+	}
+	archiveCounts.Add(a.action, 1)
+	if archived == "" {
+		logp.Info("Indexed file: '%v' %v", file, a.action)
+	} else {
+		logp.Info("Indexed file: '%v' %v: '%v'", file, a.action, archived)
+	}
+	a.Prune()
+}
+
+func (a *archiver) Folder() string {
+	return a.folder
+}
+
+// Prune removes the oldest archived files of this spool prefix until
+// at most keep_files remain, none are older than keep_days and they
+// use no more than max_disk_mb in total.
+func (a *archiver) Prune() {
+	if a.keep <= 0 && a.maxAge <= 0 && a.maxDisk <= 0 {
+		return
+	}
+	files, err := ioutil.ReadDir(a.folder)
+	if err != nil {
+		logp.Info("Archive: unable to read archive folder '%v' err: %v", a.folder, err)
+		return
+	}
+	var archived []os.FileInfo
+	var total int64
+	for _, file := range files {
+		if file.IsDir() || !a.isArchived(file.Name()) {
+			continue
+		}
+		archived = append(archived, file)
+		total += file.Size()
+	}
+	// oldest first, ReadDir sorted equal times by name:
+	sort.Stable(byModTime(archived))
+
+	now := time.Now()
+	for i, file := range archived {
+		remaining := len(archived) - i
+		reason := ""
+		switch {
+		case a.keep > 0 && remaining > a.keep:
+			reason = fmt.Sprintf("keep_files: %v", a.keep)
+		case a.maxAge > 0 && now.Sub(file.ModTime()) > a.maxAge:
+			reason = fmt.Sprintf("keep_days: %v", int(a.maxAge.Hours()/24))
+		case a.maxDisk > 0 && total > a.maxDisk:
+			reason = fmt.Sprintf("max_disk_mb: %v", a.maxDisk/1024/1024)
+		default:
+			// the rest are newer, so nothing else to prune
+			return
+		}
+		prunePath := filepath.Join(a.folder, file.Name())
+		err := os.Remove(prunePath)
+		if err != nil {
+			archiveCounts.Add("errors", 1)
+			logp.Info("Archive: unable to prune file '%v' err: %v", prunePath, err)
+			continue
+		}
+		total -= file.Size()
+		archiveCounts.Add("pruned", 1)
+		logp.Info("Archive: pruned file '%v' (%v)", prunePath, reason)
+	}
+}
+
+// isArchived matches "indexed_<unix time>.<spool prefix>...".
+func (a *archiver) isArchived(name string) bool {
+	if !strings.HasPrefix(name, archivedPrefix) {
+		return false
+	}
+	dot := strings.Index(name, ".")
+	return dot > 0 && strings.HasPrefix(name[dot+1:], a.prefix)
+}
+
+// archivedName is "indexed_<unix time>.<original filename>".
+func archivedName(file, folder string) string {
+	return filepath.Join(folder, fmt.Sprintf("%v%v.%v", archivedPrefix, time.Now().Unix(), filepath.Base(file)))
+}
+
+func archiveRename(file, folder string) (string, error) {
+	newpath := archivedName(file, folder)
+	err := os.Rename(file, newpath)
+	if err != nil {
+		// the archive folder may be on another file system:
+		err = copyFile(file, newpath)
+		if err == nil {
+			err = os.Remove(file)
+		}
+	}
+	return newpath, err
+}
+
+func archiveGzip(file, folder string) (string, error) {
+	newpath := archivedName(file, folder) + ".gz"
+	in, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	out, err := os.Create(newpath)
+	if err != nil {
+		return "", err
+	}
+	zw := gzip.NewWriter(out)
+	zw.Name = filepath.Base(file)
+	_, err = io.Copy(zw, in)
+	if err == nil {
+		err = zw.Close()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(newpath)
+		return "", err
+	}
+	return newpath, os.Remove(file)
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
+
+type byModTime []os.FileInfo
+
+func (f byModTime) Len() int           { return len(f) }
+func (f byModTime) Swap(i, j int)      { f[i], f[j] = f[j], f[i] }
+func (f byModTime) Less(i, j int) bool { return f[i].ModTime().Before(f[j].ModTime()) }
@@ -0,0 +1,245 @@
+/* Copyright (c) 2016 Chris Smith
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED ``AS IS'' AND ANY EXPRESS OR IMPLIED
+ * WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package unifiedbeat
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cleesmith/go-unified2"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/logp"
+	"github.com/elastic/beats/libbeat/publisher"
+)
+
+// Backfill indexes historical unified2 files, e.g.:
+//
+//	unifiedbeat -c unifiedbeat.yml -backfill /archive/snort.log.* /old/sensor1
+//
+// and exits when all of them have been published.
+var (
+	backfill        *bool
+	backfillWorkers *int
+	backfillSensor  *string
+)
+
+func init() {
+	backfill = flag.Bool("backfill", false, "Index the unified2 files, folders or globs given as arguments, then exit")
+	backfillWorkers = flag.Int("backfill-workers", 2, "Number of files read in parallel by -backfill")
+	backfillSensor = flag.String("backfill-sensor", "", "Name of the sensor whose Rules and fields are used by -backfill")
+}
+
+// Backfill reads each file, plain or gzip/bzip2 compressed, through the
+// same ToMapStr as the spool. Files are not archived and the registry
+// is not touched.
+func (ub *Unifiedbeat) Backfill(args []string) error {
+	sensor := ub.sensors[0]
+	if *backfillSensor != "" {
+		sensor = nil
+		for _, s := range ub.sensors {
+			if s.Name == *backfillSensor {
+				sensor = s
+			}
+		}
+		if sensor == nil {
+			return errors.New("Backfill: unknown -backfill-sensor: " + *backfillSensor)
+		}
+	}
+
+	files, err := backfillFiles(args)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return errors.New("Backfill: no unified2 files found")
+	}
+	workers := *backfillWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	logp.Info("Backfill: %v reading %v file(s) with %v worker(s)", sensor, len(files), workers)
+
+	var wg sync.WaitGroup
+	var published, failed int64
+	jobs := make(chan string)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for file := range jobs {
+				n, err := ub.backfillFile(sensor, file)
+				atomic.AddInt64(&published, int64(n))
+				if err != nil {
+					atomic.AddInt64(&failed, 1)
+					logp.Err("Backfill: '%v' stopped after %v records: %v", file, n, err)
+					continue
+				}
+				logp.Info("Backfill: '%v' published %v records", file, n)
+			}
+		}()
+	}
+	for _, file := range files {
+		if ub.stopping() {
+			break
+		}
+		jobs <- file
+	}
+	close(jobs)
+	wg.Wait()
+
+	logp.Info("Backfill: done; %v records published, %v of %v file(s) failed", published, failed, len(files))
+	if failed > 0 {
+		return fmt.Errorf("Backfill: %v of %v file(s) failed", failed, len(files))
+	}
+	return nil
+}
+
+// backfillFile publishes all records in one file and returns how many.
+func (ub *Unifiedbeat) backfillFile(sensor *Sensor, file string) (int, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	stream, err := unified2.Decompress(f)
+	if err != nil {
+		return 0, err
+	}
+	reader := unified2.NewStreamRecordReader(stream)
+
+	published := 0
+	// "publish_batch_size" records are published, and waited for, at once:
+	batch := make([]common.MapStr, 0, sensor.batchSize)
+	flush := func() {
+		if len(batch) > 0 {
+			ub.events.PublishEvents(batch, publisher.Sync, publisher.Guaranteed)
+			published += len(batch)
+			batch = make([]common.MapStr, 0, sensor.batchSize)
+		}
+	}
+	var out eventAdder = addFunc(func(event common.MapStr, source string, offset int64) {
+		batch = append(batch, event)
+		if len(batch) == sensor.batchSize {
+			flush()
+		}
+	})
+	// with "storm:" alert storms are summarized, see "beat/storm.go":
+	var storm *Storm
+	if sensor.Config.Storm.Enabled {
+		storm = NewStorm(out, sensor.Config.Storm, sensor.Config.Fields, sensor.Config.FieldsUnderRoot)
+		out = storm
+	}
+	// see "beat/docid.go":
+	ids := NewDocumentIDs(sensor.Config.DocumentId, sensor.Name)
+	// with "alerts:" records are merged into alert documents
+	// before they are added to the batch, see "beat/alerts.go":
+	var alerts *Alerts
+	if sensor.Config.Alerts.Enabled {
+		alerts = NewAlerts(out, sensor.Config.Alerts, sensor.Config.Fields, sensor.Config.FieldsUnderRoot)
+	}
+	finish := func() {
+		if alerts != nil {
+			alerts.Flush()
+		}
+		if storm != nil {
+			storm.Flush()
+		}
+		flush()
+	}
+	for !ub.stopping() {
+		record, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if raw, ok := record.(*unified2.RawRecord); ok && err == unified2.DecodingError && sensor.Config.RawRecords {
+			// the record was read but not decoded, so index it raw:
+			record, err = sensor.undecodable(raw), nil
+		}
+		if err != nil {
+			finish()
+			return published, err
+		}
+		// see "beat/raw.go":
+		record = sensor.unknownRecord(file, reader.Offset(), record)
+		if record == nil {
+			continue
+		}
+		event := sensor.NewFileEvent(file, reader.Offset(), record).ToMapStr()
+		ids.Set(record, event, file, reader.Offset())
+		if alerts != nil {
+			alerts.Add(record, event, file, reader.Offset())
+			continue
+		}
+		out.Add(event, file, reader.Offset())
+	}
+	finish()
+	return published, nil
+}
+
+// backfillFiles expands the arguments, which may be files, folders
+// (read recursively) or globs, into a sorted list of files.
+func backfillFiles(args []string) ([]string, error) {
+	found := make(map[string]bool)
+	for _, arg := range args {
+		matches, err := filepath.Glob(arg)
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			logp.Info("Backfill: nothing matches '%v'", arg)
+		}
+		for _, match := range matches {
+			err := filepath.Walk(match, func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				if info.Mode().IsRegular() {
+					found[path] = true
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	var files []string
+	for file := range found {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	return files, nil
+}
@@ -0,0 +1,119 @@
+/* Copyright (c) 2016 Chris Smith
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED ``AS IS'' AND ANY EXPRESS OR IMPLIED
+ * WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package unifiedbeat
+
+import (
+	"expvar"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/publisher"
+)
+
+var batchCounts = expvar.NewMap("unifiedbeatBatches")
+
+// Batch collects a sensor's events and publishes them together with
+// PublishEvents once "size" events are collected or the first of them
+// has waited "latency". Each batch is one registry checkpoint: the
+// registrar moves to the end of the last record in a batch once the
+// output has acknowledged the whole batch, so after a restart the
+// records are read again from a batch boundary.
+type Batch struct {
+	events  publisher.Client
+	acker   *Acker
+	size    int
+	latency time.Duration
+	pending []common.MapStr
+	source  string    // file of the last record in pending
+	offset  int64     // end of the last record in pending
+	started time.Time // when the first of pending was added
+}
+
+func NewBatch(events publisher.Client, acker *Acker, size int, latency time.Duration) *Batch {
+	return &Batch{
+		events:  events,
+		acker:   acker,
+		size:    size,
+		latency: latency,
+		pending: make([]common.MapStr, 0, size),
+	}
+}
+
+// Add appends an event, read from "source" up to "offset", and
+// publishes the batch when it is full.
+func (b *Batch) Add(event common.MapStr, source string, offset int64) {
+	if len(b.pending) == 0 {
+		b.started = time.Now()
+	}
+	b.pending = append(b.pending, event)
+	b.source = source
+	b.offset = offset
+	if len(b.pending) >= b.size {
+		batchCounts.Add("full", 1)
+		b.publish()
+	}
+}
+
+// FlushIfDue publishes the batch if its first event has waited too long.
+func (b *Batch) FlushIfDue() {
+	if len(b.pending) > 0 && time.Since(b.started) >= b.latency {
+		batchCounts.Add("timed", 1)
+		b.publish()
+	}
+}
+
+// untilDue is how long until the batch must be published, at most "max".
+func (b *Batch) untilDue(max time.Duration) time.Duration {
+	if len(b.pending) == 0 {
+		return max
+	}
+	due := b.latency - time.Since(b.started)
+	if due < 0 {
+		return 0
+	}
+	if due < max {
+		return due
+	}
+	return max
+}
+
+// Flush publishes whatever is in the batch, e.g. when there is nothing
+// more to read for now, before a file is closed, or when stopping.
+func (b *Batch) Flush() {
+	if len(b.pending) > 0 {
+		batchCounts.Add("flushed", 1)
+		b.publish()
+	}
+}
+
+func (b *Batch) publish() {
+	signal := b.acker.Signal(b.source, b.offset)
+	b.events.PublishEvents(b.pending, publisher.Guaranteed, publisher.Signal(signal))
+	batchCounts.Add("events", int64(len(b.pending)))
+	// libbeat keeps the published slice, so start a new one:
+	b.pending = make([]common.MapStr, 0, b.size)
+}
@@ -0,0 +1,112 @@
+/* Copyright (c) 2016 Chris Smith
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED ``AS IS'' AND ANY EXPRESS OR IMPLIED
+ * WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package unifiedbeat
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/elastic/beats/libbeat/logp"
+)
+
+// Classification is a "config classification: name,description,priority"
+// line from a Snort or Suricata classification.config file.
+type Classification struct {
+	Id          uint32
+	Name        string
+	Description string
+	Priority    int
+}
+
+// LoadClassifications reads a classification.config file into the
+// RuleSet, numbering the classifications from 1 in the order they are
+// read, as Snort does when it writes their ids to unified2 events.
+// Like Snort, a classification with the name of an earlier one is
+// ignored, and does not use up an id. Returns the number ignored.
+func (rs *RuleSet) LoadClassifications(classificationPath string) (int, error) {
+	var duplicateWarnings int
+	f, err := os.Open(classificationPath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	rs.Classifications = nil
+	names := make(map[string]bool)
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		aline := strings.TrimSpace(scanner.Text())
+		lineNum++
+		if !strings.HasPrefix(aline, "config") {
+			continue
+		}
+		aline = strings.TrimSpace(strings.TrimPrefix(aline, "config"))
+		if !strings.HasPrefix(aline, "classification") {
+			continue
+		}
+		aline = strings.TrimSpace(strings.TrimPrefix(aline, "classification"))
+		if !strings.HasPrefix(aline, ":") {
+			continue
+		}
+		words := strings.Split(aline[1:], ",")
+		if len(words) != 3 {
+			logp.Info("LoadClassifications: ignoring malformed classification on line# %v from file: %v", lineNum, classificationPath)
+			continue
+		}
+		name := strings.TrimSpace(words[0])
+		priority, err := strconv.Atoi(strings.TrimSpace(words[2]))
+		if name == "" || err != nil {
+			logp.Info("LoadClassifications: ignoring malformed classification on line# %v from file: %v", lineNum, classificationPath)
+			continue
+		}
+		if names[strings.ToLower(name)] {
+			logp.Info("LoadClassifications: ignoring duplicate classification '%v' on line# %v from file: %v", name, lineNum, classificationPath)
+			duplicateWarnings++
+			continue
+		}
+		names[strings.ToLower(name)] = true
+		rs.Classifications = append(rs.Classifications, Classification{
+			Id:          uint32(len(rs.Classifications) + 1),
+			Name:        name,
+			Description: strings.TrimSpace(words[1]),
+			Priority:    priority,
+		})
+	}
+	return duplicateWarnings, scanner.Err()
+}
+
+// Classification returns the classification with a unified2 event's
+// classification id.
+func (rs *RuleSet) Classification(id uint32) (Classification, bool) {
+	if rs == nil || id == 0 || int(id) > len(rs.Classifications) {
+		return Classification{}, false
+	}
+	return rs.Classifications[id-1], true
+}
@@ -27,10 +27,24 @@
 package unifiedbeat
 
 type UnifiedbeatConfig struct {
+	Name            string
 	Unified2Path    string `yaml:"unified2_path"`
 	Unified2Prefix  string `yaml:"unified2_prefix"`
 	SpoolerTimeout  int    `yaml:"spooler_timeout"`
+	SpoolWatch      string `yaml:"spool_watch"`
+	SpoolPollMs     int    `yaml:"spool_poll_interval"`
+	RegistryFile    string `yaml:"registry_file"`
+	RegistryFlush   int    `yaml:"registry_flush"`
+	BatchSize       int    `yaml:"publish_batch_size"`
+	BatchFlushMs    int    `yaml:"publish_flush_interval"`
+	DecodeWorkers   int    `yaml:"decode_workers"`
+	RawRecords      bool   `yaml:"raw_records"`
+	Alerts          AlertsConfig
+	Storm           StormConfig
+	DocumentId      string `yaml:"document_id"`
 	Spooler         SpoolerConfig
+	Archive         ArchiveConfig
+	Recovery        RecoveryConfig
 	Rules           RulesConfig
 	Geoip2Path      string `yaml:"geoip2_path"`
 	Fields          map[string]string
@@ -43,10 +57,20 @@ type SpoolerConfig struct {
 }
 
 type RulesConfig struct {
-	GenMsgMapPath string `yaml:"gen_msg_map_path"`
-	Paths         []string
+	GenMsgMapPath      string `yaml:"gen_msg_map_path"`
+	ClassificationPath string `yaml:"classification_path"`
+	ReferencePath      string `yaml:"reference_path"`
+	Paths              []string
+	HistoryPaths       []string `yaml:"history_paths"`
+	Watch              bool
+	WatchDelay         int `yaml:"watch_delay"`
+	KeepRevisions      int `yaml:"keep_revisions"`
 }
 
+// ConfigSettings holds either a single "sensor" or a list of
+// "sensors", which are spooled and published concurrently.
 type ConfigSettings struct {
-	Sensor UnifiedbeatConfig
+	Sensor     UnifiedbeatConfig
+	Sensors    []UnifiedbeatConfig
+	PcapListen string `yaml:"pcap_listen"`
 }
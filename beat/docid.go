@@ -0,0 +1,226 @@
+/* Copyright (c) 2016 Chris Smith
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED ``AS IS'' AND ANY EXPRESS OR IMPLIED
+ * WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package unifiedbeat
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/cleesmith/go-unified2"
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/logp"
+)
+
+// DocumentIDs gives each document a stable id in "@metadata._id",
+// which the elasticsearch output uses as the document's _id, so a
+// record read again (after a crash, a registry reset or by a backfill)
+// overwrites its document instead of indexing it twice.
+//
+// With "event" ids are "<sensor_id>-<event_second>-<event_id>-event",
+// "...-packet-<record type>-<n>" and "...-extradata-<record type>-<n>",
+// where n counts the packets (or extra data) of the event from 0 in the
+// order written, prefixed by the sensor's name if it has one.  Two
+// identical packets of an event still get their own ids.  These come
+// from the records, not from where they were read; when reading resumes
+// part way through an event, the records of the event before it in the
+// file are counted again.  An alert document keeps the id of its event.
+// Records that do not belong to an event, and all records with
+// "offset", get "<fingerprint>-<offset>": a hash of the file's first
+// record and the offset of the end of the record, which do not change
+// when a file is renamed, archived or compressed.
+type DocumentIDs struct {
+	scheme string
+	prefix string
+	// the fingerprint of the last file:
+	source      string
+	fingerprint string
+	// the event of the last record, and how many of its
+	// packets and extra data, by record type, were seen:
+	event    alertKey
+	ordinals map[uint32]int
+}
+
+// NewDocumentIDs returns nil for no ids, so Elasticsearch assigns them.
+func NewDocumentIDs(scheme string, sensorName string) *DocumentIDs {
+	if scheme == "" {
+		return nil
+	}
+	d := &DocumentIDs{scheme: scheme}
+	if sensorName != "" {
+		d.prefix = sensorName + "-"
+	}
+	return d
+}
+
+// Set adds the id of a record, read from "source" up to "offset", to
+// its document.
+func (d *DocumentIDs) Set(record interface{}, event common.MapStr, source string, offset int64) {
+	if d == nil {
+		return
+	}
+	id := ""
+	if d.scheme == "event" {
+		id = d.eventID(record, source, offset)
+	}
+	if id == "" {
+		fingerprint := d.fileFingerprint(source)
+		if fingerprint == "" {
+			return
+		}
+		id = fmt.Sprintf("%v-%v", fingerprint, offset)
+	}
+	event["@metadata"] = common.MapStr{"_id": id}
+}
+
+// eventID is "" for records that do not belong to an event. Records
+// must be given in the order read.
+func (d *DocumentIDs) eventID(record interface{}, source string, offset int64) string {
+	key, recordType, ok := eventPart(record)
+	if !ok {
+		return ""
+	}
+	var kind string
+	switch record.(type) {
+	case *unified2.EventRecord, *unified2.AppIdEventRecord:
+		d.event, d.ordinals = key, make(map[uint32]int)
+		kind = "event"
+	default:
+		if key != d.event {
+			d.event, d.ordinals = key, d.ordinalsBefore(source, offset, key)
+		}
+		name := "packet"
+		if _, extra := record.(*unified2.ExtraDataRecord); extra {
+			name = "extradata"
+		}
+		kind = fmt.Sprintf("%v-%v-%v", name, recordType, d.ordinals[recordType])
+		d.ordinals[recordType]++
+	}
+	return fmt.Sprintf("%v%v-%v-%v-%v", d.prefix, key.sensorId, key.eventSecond, key.eventId, kind)
+}
+
+// eventPart returns the event a record belongs to and its record type.
+func eventPart(record interface{}) (alertKey, uint32, bool) {
+	switch r := record.(type) {
+	case *unified2.EventRecord:
+		return alertKey{r.SensorId, r.EventId, r.EventSecond}, r.Type, true
+	case *unified2.AppIdEventRecord:
+		return alertKey{r.SensorId, r.EventId, r.EventSecond}, r.Type, true
+	case *unified2.PacketRecord:
+		return alertKey{r.SensorId, r.EventId, r.EventSecond}, unified2.UNIFIED2_PACKET, true
+	case *unified2.ExtraDataRecord:
+		recordType := r.EventType
+		if recordType == 0 {
+			recordType = unified2.UNIFIED2_EXTRA_DATA
+		}
+		return alertKey{r.SensorId, r.EventId, r.EventSecond}, recordType, true
+	}
+	return alertKey{}, 0, false
+}
+
+// ordinalsBefore counts, by record type, the packets and extra data of
+// an event that come before the record ending at "offset" in a file,
+// for when reading resumed part way through the event.
+func (d *DocumentIDs) ordinalsBefore(source string, offset int64, key alertKey) map[uint32]int {
+	ordinals := make(map[uint32]int)
+	f, err := os.Open(source)
+	if err != nil {
+		logp.Info("DocumentIDs: unable to count the records before offset %v in '%v' err: %v", offset, source, err)
+		return ordinals
+	}
+	defer f.Close()
+	stream, err := unified2.Decompress(f)
+	if err != nil {
+		logp.Info("DocumentIDs: unable to count the records before offset %v in '%v' err: %v", offset, source, err)
+		return ordinals
+	}
+	reader := unified2.NewStreamRecordReader(stream)
+	for {
+		record, err := reader.Next()
+		if err != nil && err != unified2.DecodingError {
+			if err != io.EOF {
+				logp.Info("DocumentIDs: unable to count the records before offset %v in '%v' err: %v", offset, source, err)
+			}
+			return ordinals
+		}
+		if reader.Offset() >= offset {
+			return ordinals
+		}
+		switch record.(type) {
+		case *unified2.PacketRecord, *unified2.ExtraDataRecord:
+			if recordKey, recordType, _ := eventPart(record); recordKey == key {
+				ordinals[recordType]++
+			}
+		}
+	}
+}
+
+// fileFingerprint is the fingerprint of a file's first record.
+func (d *DocumentIDs) fileFingerprint(source string) string {
+	if source == d.source {
+		return d.fingerprint
+	}
+	fingerprint, err := firstRecordFingerprint(source)
+	if err != nil {
+		logp.Info("DocumentIDs: unable to fingerprint '%v' err: %v", source, err)
+		return ""
+	}
+	d.source = source
+	d.fingerprint = fingerprint
+	return fingerprint
+}
+
+// firstRecordFingerprint hashes the first record of a plain or
+// compressed unified2 file.
+func firstRecordFingerprint(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	stream, err := unified2.Decompress(f)
+	if err != nil {
+		return "", err
+	}
+	header := make([]byte, unified2.RAW_HEADER_LEN)
+	if _, err := io.ReadFull(stream, header); err != nil {
+		return "", err
+	}
+	length := binary.BigEndian.Uint32(header[4:])
+	if length > unified2.MAX_RECORD_LEN {
+		return "", unified2.HeaderError
+	}
+	hash := sha1.New()
+	hash.Write(header)
+	if _, err := io.CopyN(hash, stream, int64(length)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:16], nil
+}
@@ -0,0 +1,128 @@
+/* Copyright (c) 2016 Chris Smith
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED ``AS IS'' AND ANY EXPRESS OR IMPLIED
+ * WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package unifiedbeat
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/cleesmith/go-unified2"
+	"github.com/elastic/beats/libbeat/common"
+)
+
+// Two identical packets of an event get their own ids, and the same
+// ids when reading resumes part way through the event.
+func TestDocumentIDsEvent(t *testing.T) {
+	folder, err := ioutil.TempDir("", "unifiedbeat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+	filename := filepath.Join(folder, "snort.log.1")
+
+	packet := func(eventId uint32) *unified2.PacketRecord {
+		return &unified2.PacketRecord{SensorId: 1, EventId: eventId, EventSecond: 1000,
+			PacketSecond: 1000, PacketMicrosecond: 5, LinkType: 1, Data: []byte("same packet")}
+	}
+	records := []interface{}{
+		&unified2.EventRecord{SensorId: 1, EventId: 5, EventSecond: 1000,
+			GeneratorId: 1, SignatureId: 1000, SignatureRevision: 1,
+			IpSource: []byte{10, 0, 0, 1}, IpDestination: []byte{10, 0, 0, 2}},
+		packet(5),
+		packet(5),
+		&unified2.ExtraDataRecord{SensorId: 1, EventId: 5, EventSecond: 1000,
+			Type: 1, DataType: 1, Data: []byte{10, 0, 0, 3}},
+		packet(5),
+		&unified2.EventRecord{SensorId: 1, EventId: 6, EventSecond: 1000,
+			GeneratorId: 1, SignatureId: 1000, SignatureRevision: 1,
+			IpSource: []byte{10, 0, 0, 1}, IpDestination: []byte{10, 0, 0, 2}},
+		packet(6),
+	}
+	var buf bytes.Buffer
+	for _, record := range records {
+		raw, err := unified2.EncodeRecord(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := unified2.WriteRawRecord(&buf, raw); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(t, filename, buf.Bytes())
+
+	reader, err := unified2.NewRecordReader(filename, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var read []interface{}
+	var offsets []int64
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		read = append(read, record)
+		offsets = append(offsets, reader.Offset())
+	}
+	reader.Close()
+
+	ids := func(from int) []string {
+		d := NewDocumentIDs("event", "nucy")
+		var ids []string
+		for i := from; i < len(read); i++ {
+			event := common.MapStr{}
+			d.Set(read[i], event, filename, offsets[i])
+			ids = append(ids, event["@metadata"].(common.MapStr)["_id"].(string))
+		}
+		return ids
+	}
+	expected := []string{
+		"nucy-1-1000-5-event",
+		"nucy-1-1000-5-packet-2-0",
+		"nucy-1-1000-5-packet-2-1",
+		"nucy-1-1000-5-extradata-110-0",
+		"nucy-1-1000-5-packet-2-2",
+		"nucy-1-1000-6-event",
+		"nucy-1-1000-6-packet-2-0",
+	}
+	if got := ids(0); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("got %v expected %v", got, expected)
+	}
+	for from := 1; from < len(read); from++ {
+		if got := ids(from); !reflect.DeepEqual(got, expected[from:]) {
+			t.Errorf("resumed at record %v got %v expected %v", from, got, expected[from:])
+		}
+	}
+}
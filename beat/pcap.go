@@ -0,0 +1,179 @@
+/* Copyright (c) 2016 Chris Smith
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED ``AS IS'' AND ANY EXPRESS OR IMPLIED
+ * WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package unifiedbeat
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/cleesmith/go-unified2"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// The snapshot length written to pcap and pcapng headers, as no
+// unified2 packet is longer.
+const pcapSnapLen = 65535
+
+// The most events remembered for the comments of their packets, a
+// packet record normally follows its event record closely.
+const pcapMaxEvents = 4096
+
+// PcapWriter writes the packet records of unified2 files to a pcap or
+// pcapng file, to be opened in Wireshark.  A pcap file has a single
+// LinkType, that of the first packet, so packets of any other
+// LinkType are skipped.  In a pcapng file each packet has a comment
+// with the gid:sid, signature and event_id of its event.
+type PcapWriter struct {
+	format  string
+	pcap    *pcapgo.Writer
+	ng      *ngWriter
+	ruleSet *RuleSet
+
+	linkType uint32
+	started  bool
+	events   map[pcapEventKey]*unified2.EventRecord
+
+	Packets int // packets written
+	Skipped int // packets of another LinkType, pcap only
+}
+
+// pcapEventKey links a packet record to its event record
+type pcapEventKey struct {
+	sensorId, eventId, eventSecond uint32
+}
+
+// NewPcapWriter writes "pcap" or "pcapng" to w; the signatures in the
+// comments come from ruleSet, which may be nil.
+func NewPcapWriter(w io.Writer, format string, ruleSet *RuleSet) (*PcapWriter, error) {
+	p := &PcapWriter{
+		format:  format,
+		ruleSet: ruleSet,
+		events:  make(map[pcapEventKey]*unified2.EventRecord),
+	}
+	switch format {
+	case "pcap":
+		p.pcap = pcapgo.NewWriter(w)
+	case "pcapng":
+		p.ng = newNgWriter(w)
+	default:
+		return nil, fmt.Errorf("unknown packet capture format: '%v'", format)
+	}
+	return p, nil
+}
+
+// Write writes a packet record, remembers an event record for the
+// comments of the packets that follow it, and ignores other records.
+func (p *PcapWriter) Write(record interface{}) error {
+	switch r := record.(type) {
+	case *unified2.AppIdEventRecord:
+		p.remember(&r.EventRecord)
+	case *unified2.EventRecord:
+		p.remember(r)
+	case *unified2.PacketRecord:
+		return p.writePacket(r)
+	}
+	return nil
+}
+
+func (p *PcapWriter) remember(event *unified2.EventRecord) {
+	if len(p.events) >= pcapMaxEvents {
+		p.events = make(map[pcapEventKey]*unified2.EventRecord)
+	}
+	p.events[pcapEventKey{event.SensorId, event.EventId, event.EventSecond}] = event
+}
+
+func (p *PcapWriter) writePacket(packet *unified2.PacketRecord) error {
+	timestamp := time.Unix(int64(packet.PacketSecond), int64(packet.PacketMicrosecond)*1000)
+	if p.pcap != nil {
+		if !p.started {
+			if err := p.pcap.WriteFileHeader(pcapSnapLen, layers.LinkType(packet.LinkType)); err != nil {
+				return err
+			}
+			p.linkType = packet.LinkType
+			p.started = true
+		}
+		if packet.LinkType != p.linkType {
+			p.Skipped++
+			return nil
+		}
+		ci := gopacket.CaptureInfo{
+			Timestamp:     timestamp,
+			CaptureLength: len(packet.Data),
+			Length:        len(packet.Data),
+		}
+		if err := p.pcap.WritePacket(ci, packet.Data); err != nil {
+			return err
+		}
+		p.Packets++
+		return nil
+	}
+	err := p.ng.writePacket(packet.LinkType, timestamp, packet.Data, p.comment(packet))
+	if err != nil {
+		return err
+	}
+	p.Packets++
+	return nil
+}
+
+// comment is "[gid:sid:rev] signature event_id: N sensor_id: N", or
+// just the ids when the event record was not seen.
+func (p *PcapWriter) comment(packet *unified2.PacketRecord) string {
+	ids := fmt.Sprintf("event_id: %v sensor_id: %v", packet.EventId, packet.SensorId)
+	event, ok := p.events[pcapEventKey{packet.SensorId, packet.EventId, packet.EventSecond}]
+	if !ok {
+		return ids
+	}
+	signature := ""
+	if rule, found, _ := p.ruleSet.LookupRevision(event.GeneratorId, event.SignatureId, event.SignatureRevision); found {
+		signature = rule.Msg + " "
+	}
+	return fmt.Sprintf("[%v:%v:%v] %v%v", event.GeneratorId, event.SignatureId, event.SignatureRevision, signature, ids)
+}
+
+// ContentType is the MIME type of the format written.
+func (p *PcapWriter) ContentType() string {
+	if p.format == "pcapng" {
+		return "application/x-pcapng"
+	}
+	return "application/vnd.tcpdump.pcap"
+}
+
+// Close finishes the file, so one without any packets is still valid;
+// it does not close the underlying writer.
+func (p *PcapWriter) Close() error {
+	if p.pcap != nil && !p.started {
+		p.started = true
+		return p.pcap.WriteFileHeader(pcapSnapLen, layers.LinkTypeEthernet)
+	}
+	if p.ng != nil {
+		return p.ng.start()
+	}
+	return nil
+}
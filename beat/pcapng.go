@@ -0,0 +1,146 @@
+/* Copyright (c) 2016 Chris Smith
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED ``AS IS'' AND ANY EXPRESS OR IMPLIED
+ * WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package unifiedbeat
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// pcapng block types and options, see
+// https://github.com/pcapng/pcapng
+const (
+	ngSectionHeaderBlock   = 0x0A0D0D0A
+	ngInterfaceBlock       = 0x00000001
+	ngEnhancedPacketBlock  = 0x00000006
+	ngByteOrderMagic       = 0x1A2B3C4D
+	ngOptionEnd            = 0
+	ngOptionComment        = 1
+	ngOptionInterfaceName  = 2
+	ngVersionMajor         = 1
+	ngVersionMinor         = 0
+	ngUnknownSectionLength = -1
+)
+
+// ngWriter writes a pcapng section, little-endian with microsecond
+// timestamps, adding an interface for each LinkType it is given.
+type ngWriter struct {
+	w          io.Writer
+	started    bool
+	interfaces map[uint32]uint32 // LinkType to interface id
+}
+
+func newNgWriter(w io.Writer) *ngWriter {
+	return &ngWriter{w: w, interfaces: make(map[uint32]uint32)}
+}
+
+// start writes the section header block, once.
+func (n *ngWriter) start() error {
+	if n.started {
+		return nil
+	}
+	n.started = true
+	body := make([]byte, 16)
+	binary.LittleEndian.PutUint32(body[0:], ngByteOrderMagic)
+	binary.LittleEndian.PutUint16(body[4:], ngVersionMajor)
+	binary.LittleEndian.PutUint16(body[6:], ngVersionMinor)
+	sectionLength := int64(ngUnknownSectionLength)
+	binary.LittleEndian.PutUint64(body[8:], uint64(sectionLength))
+	return n.writeBlock(ngSectionHeaderBlock, body)
+}
+
+// writePacket writes an enhanced packet block, after the section header
+// and interface description blocks it needs.
+func (n *ngWriter) writePacket(linkType uint32, timestamp time.Time, data []byte, comment string) error {
+	if err := n.start(); err != nil {
+		return err
+	}
+	id, ok := n.interfaces[linkType]
+	if !ok {
+		id = uint32(len(n.interfaces))
+		body := make([]byte, 8)
+		binary.LittleEndian.PutUint16(body[0:], uint16(linkType))
+		binary.LittleEndian.PutUint32(body[4:], pcapSnapLen)
+		body = appendOption(body, ngOptionInterfaceName, "unified2")
+		body = appendOption(body, ngOptionEnd, "")
+		if err := n.writeBlock(ngInterfaceBlock, body); err != nil {
+			return err
+		}
+		n.interfaces[linkType] = id
+	}
+
+	micros := uint64(timestamp.UnixNano() / 1000)
+	body := make([]byte, 20, 20+len(data)+3+len(comment)+16)
+	binary.LittleEndian.PutUint32(body[0:], id)
+	binary.LittleEndian.PutUint32(body[4:], uint32(micros>>32))
+	binary.LittleEndian.PutUint32(body[8:], uint32(micros))
+	binary.LittleEndian.PutUint32(body[12:], uint32(len(data)))
+	binary.LittleEndian.PutUint32(body[16:], uint32(len(data)))
+	body = append(body, pad(data)...)
+	if comment != "" {
+		body = appendOption(body, ngOptionComment, comment)
+		body = appendOption(body, ngOptionEnd, "")
+	}
+	return n.writeBlock(ngEnhancedPacketBlock, body)
+}
+
+// writeBlock writes the block type and total length around body, whose
+// length must be a multiple of 4.
+func (n *ngWriter) writeBlock(blockType uint32, body []byte) error {
+	length := uint32(12 + len(body))
+	block := make([]byte, 0, length)
+	block = appendUint32(block, blockType)
+	block = appendUint32(block, length)
+	block = append(block, body...)
+	block = appendUint32(block, length)
+	_, err := n.w.Write(block)
+	return err
+}
+
+// appendOption appends an option code, length and padded value.
+func appendOption(b []byte, code uint16, value string) []byte {
+	var header [4]byte
+	binary.LittleEndian.PutUint16(header[0:], code)
+	binary.LittleEndian.PutUint16(header[2:], uint16(len(value)))
+	b = append(b, header[:]...)
+	return append(b, pad([]byte(value))...)
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+// pad returns data padded with zeros to a multiple of 4 bytes.
+func pad(data []byte) []byte {
+	if len(data)%4 == 0 {
+		return data
+	}
+	return append(append([]byte{}, data...), make([]byte, 4-len(data)%4)...)
+}
@@ -0,0 +1,171 @@
+/* Copyright (c) 2016 Chris Smith
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED ``AS IS'' AND ANY EXPRESS OR IMPLIED
+ * WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package unifiedbeat
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/cleesmith/go-unified2"
+)
+
+// ngBlock is a block read back from a pcapng file.
+type ngBlock struct {
+	blockType uint32
+	body      []byte
+}
+
+// readNgBlocks splits a pcapng file into its blocks, checking that each
+// block length is a multiple of 4 and is repeated after the body.
+func readNgBlocks(t *testing.T, data []byte) []ngBlock {
+	var blocks []ngBlock
+	for len(data) > 0 {
+		if len(data) < 12 {
+			t.Fatalf("%v bytes left, too short for a block", len(data))
+		}
+		length := binary.LittleEndian.Uint32(data[4:])
+		if length%4 != 0 || length < 12 || int(length) > len(data) {
+			t.Fatalf("bad block length %v with %v bytes left", length, len(data))
+		}
+		if trailing := binary.LittleEndian.Uint32(data[length-4:]); trailing != length {
+			t.Fatalf("block length %v, trailing length %v", length, trailing)
+		}
+		blocks = append(blocks, ngBlock{binary.LittleEndian.Uint32(data), data[8 : length-4]})
+		data = data[length:]
+	}
+	return blocks
+}
+
+func TestPcapngBlocks(t *testing.T) {
+	event := &unified2.EventRecord{SensorId: 1, EventId: 42, EventSecond: 1452978988,
+		GeneratorId: 1, SignatureId: 2100498, SignatureRevision: 7}
+	packet := func(linkType uint32, data string) *unified2.PacketRecord {
+		return &unified2.PacketRecord{SensorId: 1, EventId: 42, EventSecond: 1452978988,
+			PacketSecond: 1452978988, PacketMicrosecond: 250, LinkType: linkType, Data: []byte(data)}
+	}
+	orphan := packet(1, "no event")
+	orphan.EventId = 43
+
+	tests := []struct {
+		name     string
+		records  []interface{}
+		blocks   []uint32
+		comments []string
+	}{
+		{
+			"no packets",
+			nil,
+			[]uint32{ngSectionHeaderBlock},
+			nil,
+		},
+		{
+			"an event and its packets",
+			[]interface{}{event, packet(1, "first"), packet(1, "second!!")},
+			[]uint32{ngSectionHeaderBlock, ngInterfaceBlock, ngEnhancedPacketBlock, ngEnhancedPacketBlock},
+			[]string{"[1:2100498:7] event_id: 42 sensor_id: 1", "[1:2100498:7] event_id: 42 sensor_id: 1"},
+		},
+		{
+			"an interface for each LinkType",
+			[]interface{}{event, packet(1, "ethernet"), packet(101, "raw ip"), packet(1, "ethernet")},
+			[]uint32{ngSectionHeaderBlock, ngInterfaceBlock, ngEnhancedPacketBlock,
+				ngInterfaceBlock, ngEnhancedPacketBlock, ngEnhancedPacketBlock},
+			[]string{"[1:2100498:7]", "[1:2100498:7]", "[1:2100498:7]"},
+		},
+		{
+			"a packet without its event",
+			[]interface{}{orphan},
+			[]uint32{ngSectionHeaderBlock, ngInterfaceBlock, ngEnhancedPacketBlock},
+			[]string{"event_id: 43 sensor_id: 1"},
+		},
+	}
+
+	for _, test := range tests {
+		var buf bytes.Buffer
+		writer, err := NewPcapWriter(&buf, "pcapng", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var packets []*unified2.PacketRecord
+		for _, record := range test.records {
+			if err := writer.Write(record); err != nil {
+				t.Fatalf("%v: %v", test.name, err)
+			}
+			if p, ok := record.(*unified2.PacketRecord); ok {
+				packets = append(packets, p)
+			}
+		}
+		if err := writer.Close(); err != nil {
+			t.Fatalf("%v: %v", test.name, err)
+		}
+
+		blocks := readNgBlocks(t, buf.Bytes())
+		if len(blocks) != len(test.blocks) {
+			t.Errorf("%v: %v blocks, expected %v", test.name, len(blocks), len(test.blocks))
+			continue
+		}
+		interfaces := make(map[uint32]uint16) // id to LinkType
+		packetIndex := 0
+		for i, block := range blocks {
+			if block.blockType != test.blocks[i] {
+				t.Errorf("%v: block %v is type %#x, expected %#x", test.name, i, block.blockType, test.blocks[i])
+				continue
+			}
+			switch block.blockType {
+			case ngSectionHeaderBlock:
+				if magic := binary.LittleEndian.Uint32(block.body); magic != ngByteOrderMagic {
+					t.Errorf("%v: byte order magic %#x", test.name, magic)
+				}
+			case ngInterfaceBlock:
+				interfaces[uint32(len(interfaces))] = binary.LittleEndian.Uint16(block.body)
+			case ngEnhancedPacketBlock:
+				p := packets[packetIndex]
+				id := binary.LittleEndian.Uint32(block.body)
+				if linkType, ok := interfaces[id]; !ok || uint32(linkType) != p.LinkType {
+					t.Errorf("%v: packet %v on interface %v of LinkType %v, expected %v", test.name, packetIndex, id, linkType, p.LinkType)
+				}
+				micros := uint64(binary.LittleEndian.Uint32(block.body[4:]))<<32 | uint64(binary.LittleEndian.Uint32(block.body[8:]))
+				if expected := uint64(p.PacketSecond)*1000000 + uint64(p.PacketMicrosecond); micros != expected {
+					t.Errorf("%v: packet %v timestamp %v, expected %v", test.name, packetIndex, micros, expected)
+				}
+				captured := binary.LittleEndian.Uint32(block.body[12:])
+				if captured != uint32(len(p.Data)) || !bytes.Equal(block.body[20:20+captured], p.Data) {
+					t.Errorf("%v: packet %v data %q, expected %q", test.name, packetIndex, block.body[20:20+captured], p.Data)
+				}
+				options := block.body[20+len(pad(p.Data)):]
+				code := binary.LittleEndian.Uint16(options)
+				length := binary.LittleEndian.Uint16(options[2:])
+				comment := string(options[4 : 4+length])
+				if code != ngOptionComment || !strings.HasPrefix(comment, test.comments[packetIndex]) {
+					t.Errorf("%v: packet %v comment %v %q, expected %q", test.name, packetIndex, code, comment, test.comments[packetIndex])
+				}
+				packetIndex++
+			}
+		}
+	}
+}
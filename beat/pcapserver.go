@@ -0,0 +1,302 @@
+/* Copyright (c) 2016 Chris Smith
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED ``AS IS'' AND ANY EXPRESS OR IMPLIED
+ * WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package unifiedbeat
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/cleesmith/go-unified2"
+	"github.com/elastic/beats/libbeat/logp"
+)
+
+// ServePcap serves the packets of an event as a pcapng (or pcap) file
+// download, from the unified2 files in the spool (and archive)
+// folders of the sensors:
+//
+//	GET /pcap?event_id=N[&event_second=N][&sensor_id=N][&sensor=name][&format=pcap]
+//
+// event_id starts over when Snort restarts, so without event_second
+// the packets come from the newest file holding that event_id.
+// The listener is returned so it can be closed.  Without a host, e.g.
+// ":5080" or just "5080", it only listens on 127.0.0.1.
+func ServePcap(address string, sensors []*Sensor) (net.Listener, error) {
+	listener, err := net.Listen("tcp", pcapListenAddress(address))
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/pcap", &pcapHandler{sensors})
+	go http.Serve(listener, mux)
+	logp.Info("ServePcap: serving event packets at http://%v/pcap?event_id=", listener.Addr())
+	return listener, nil
+}
+
+// pcapListenAddress defaults the host of address to 127.0.0.1, as the
+// packets of alerts are not for everyone on the network.
+func pcapListenAddress(address string) string {
+	if !strings.Contains(address, ":") {
+		return net.JoinHostPort("127.0.0.1", address)
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err == nil && host == "" {
+		return net.JoinHostPort("127.0.0.1", port)
+	}
+	return address
+}
+
+type pcapHandler struct {
+	sensors []*Sensor
+}
+
+// pcapQuery is what to look for, -1 matches any
+type pcapQuery struct {
+	eventId     int64
+	eventSecond int64
+	sensorId    int64
+}
+
+func (q pcapQuery) matches(sensorId, eventId, eventSecond uint32) bool {
+	return int64(eventId) == q.eventId &&
+		(q.eventSecond < 0 || int64(eventSecond) == q.eventSecond) &&
+		(q.sensorId < 0 || int64(sensorId) == q.sensorId)
+}
+
+func (h *pcapHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	number := func(name string) (int64, error) {
+		value := params.Get(name)
+		if value == "" {
+			return -1, nil
+		}
+		return strconv.ParseInt(value, 10, 64)
+	}
+	var query pcapQuery
+	var err error
+	if query.eventId, err = number("event_id"); err != nil || query.eventId < 0 {
+		http.Error(w, "event_id is required", http.StatusBadRequest)
+		return
+	}
+	if query.eventSecond, err = number("event_second"); err != nil {
+		http.Error(w, "invalid event_second", http.StatusBadRequest)
+		return
+	}
+	if query.sensorId, err = number("sensor_id"); err != nil {
+		http.Error(w, "invalid sensor_id", http.StatusBadRequest)
+		return
+	}
+	format := params.Get("format")
+	if format == "" {
+		format = "pcapng"
+	}
+
+	for _, sensor := range h.sensors {
+		if name := params.Get("sensor"); name != "" && name != sensor.Name {
+			continue
+		}
+		records, source, err := sensor.eventRecords(query)
+		if err != nil {
+			logp.Info("ServePcap: %v event_id %v err: %v", sensor, query.eventId, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(records) == 0 {
+			continue
+		}
+		var buf bytes.Buffer
+		writer, err := NewPcapWriter(&buf, format, sensor.RuleSet())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, record := range records {
+			if err = writer.Write(record); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = writer.Close()
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		logp.Info("ServePcap: %v event_id %v: %v packets from '%v'", sensor, query.eventId, writer.Packets, source)
+		w.Header().Set("Content-Type", writer.ContentType())
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"event_%v.%v\"", query.eventId, format))
+		w.Write(buf.Bytes())
+		return
+	}
+	http.Error(w, fmt.Sprintf("no packets found for event_id %v", query.eventId), http.StatusNotFound)
+}
+
+// pcapScanFiles is how many unified2 files are searched for an event
+// at most, newest first, so a request for an event_id that is long gone
+// doesn't read the whole archive.
+const pcapScanFiles = 50
+
+// eventRecords returns the event and packet records of an event, from
+// the newest unified2 file of this sensor that has any of its packets.
+func (s *Sensor) eventRecords(query pcapQuery) ([]interface{}, string, error) {
+	scanned := 0
+	for _, file := range s.unified2Files() {
+		if scanned == pcapScanFiles {
+			logp.Info("ServePcap: %v event_id %v not found in the newest %v files", s, query.eventId, pcapScanFiles)
+			break
+		}
+		records, read, err := eventRecordsIn(file, query)
+		if err != nil {
+			return nil, "", err
+		}
+		if read {
+			scanned++
+		}
+		for _, record := range records {
+			if _, ok := record.(*unified2.PacketRecord); ok {
+				return records, file, nil
+			}
+		}
+	}
+	return nil, "", nil
+}
+
+// eventRecordsIn scans a plain or compressed unified2 file.  With an
+// event_second, plain files are skipped when their first record is
+// newer than the event, or searched from the first record at or after
+// event_second, the same way -since starts reading.  It returns false
+// when the file was skipped.
+func eventRecordsIn(file string, query pcapQuery) ([]interface{}, bool, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// archived or pruned meanwhile
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	defer f.Close()
+	if query.eventSecond >= 0 && !compressed(f) {
+		first, ok := unified2.FirstRecordSecond(file)
+		if ok && int64(first) > query.eventSecond {
+			return nil, false, nil
+		}
+		_, err = unified2.SeekTime(f, uint32(query.eventSecond))
+		if err == io.EOF {
+			return nil, false, nil
+		}
+		if err != nil {
+			return nil, true, err
+		}
+	}
+	stream, err := unified2.Decompress(f)
+	if err != nil {
+		return nil, true, err
+	}
+	var records []interface{}
+	reader := unified2.NewStreamRecordReader(stream)
+	for {
+		record, err := reader.Next()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// the end, or the partial record being written
+			return records, true, nil
+		}
+		if err == unified2.DecodingError {
+			continue
+		}
+		if err != nil {
+			return records, true, err
+		}
+		switch r := record.(type) {
+		case *unified2.AppIdEventRecord:
+			if query.matches(r.SensorId, r.EventId, r.EventSecond) {
+				records = append(records, r)
+			}
+		case *unified2.EventRecord:
+			if query.matches(r.SensorId, r.EventId, r.EventSecond) {
+				records = append(records, r)
+			}
+		case *unified2.PacketRecord:
+			if query.matches(r.SensorId, r.EventId, r.EventSecond) {
+				records = append(records, r)
+			}
+		}
+	}
+}
+
+// compressed tells whether a file is gzip or bzip2 compressed, see
+// decompress, leaving it at its start.
+func compressed(f *os.File) bool {
+	magic := make([]byte, 3)
+	n, _ := f.ReadAt(magic, 0)
+	magic = magic[:n]
+	return (len(magic) >= 2 && magic[0] == 0x1f && magic[1] == 0x8b) ||
+		(len(magic) == 3 && string(magic) == "BZh")
+}
+
+// unified2Files lists the spool files and archived files of this
+// sensor, newest first.
+func (s *Sensor) unified2Files() []string {
+	folders := []string{s.Config.Spooler.Folder}
+	if archive := s.archiver.Folder(); archive != s.Config.Spooler.Folder {
+		folders = append(folders, archive)
+	}
+	var found []os.FileInfo
+	paths := make(map[os.FileInfo]string)
+	for _, folder := range folders {
+		files, err := ioutil.ReadDir(folder)
+		if err != nil {
+			continue
+		}
+		for _, file := range files {
+			name := file.Name()
+			if strings.HasPrefix(name, archivedPrefix) {
+				// "indexed_<unix time>.<original filename>"
+				name = name[strings.Index(name, ".")+1:]
+			}
+			if file.IsDir() || !strings.HasPrefix(name, s.Config.Spooler.FilePrefix) {
+				continue
+			}
+			found = append(found, file)
+			paths[file] = filepath.Join(folder, file.Name())
+		}
+	}
+	sort.Sort(sort.Reverse(byModTime(found)))
+	var names []string
+	for _, file := range found {
+		names = append(names, paths[file])
+	}
+	return names
+}
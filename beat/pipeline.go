@@ -0,0 +1,220 @@
+/* Copyright (c) 2016 Chris Smith
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED ``AS IS'' AND ANY EXPRESS OR IMPLIED
+ * WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package unifiedbeat
+
+import (
+	"sync"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+)
+
+// Pipeline turns a sensor's records into events on several decode
+// goroutines, as ToMapStr does the gopacket decoding, GeoIP and rule
+// lookups, then adds them to the sensor's Batch on one goroutine in
+// the order they were read, so the registry offsets stay in order.
+// Both queues are bounded, so Submit blocks when the workers or the
+// output fall behind, but not once the sensor is stopping.
+type Pipeline struct {
+	sensor    *Sensor
+	batch     *Batch
+	alerts    *Alerts         // nil unless records are merged into alerts
+	storm     *Storm          // nil unless alert storms are summarized
+	out       eventAdder      // the batch, or the storm in front of it
+	ids       *DocumentIDs    // nil unless documents have an id
+	work      chan *decodeJob // to the decode workers
+	ordered   chan *decodeJob // to the publisher, in the order read
+	workers   sync.WaitGroup
+	published chan struct{}   // closed once the publisher has returned
+	stop      <-chan struct{} // closed when the sensor is stopping
+}
+
+// decodeJob is one record on its way through the Pipeline.
+type decodeJob struct {
+	source string
+	offset int64
+	record interface{}
+	event  common.MapStr
+	ready  chan struct{} // closed once event is decoded
+	synced chan struct{} // only set by Sync, closed once flushed
+}
+
+// NewPipeline starts "workers" decode goroutines and the publisher
+// goroutine, with room for "queue" records between them.
+func NewPipeline(sensor *Sensor, batch *Batch, workers, queue int) *Pipeline {
+	p := &Pipeline{
+		sensor:    sensor,
+		batch:     batch,
+		work:      make(chan *decodeJob, queue),
+		ordered:   make(chan *decodeJob, queue),
+		published: make(chan struct{}),
+		stop:      sensor.done,
+	}
+	p.ids = NewDocumentIDs(sensor.Config.DocumentId, sensor.Name) // see "beat/docid.go"
+	p.out = batch
+	if sensor.Config.Storm.Enabled {
+		// see "beat/storm.go":
+		p.storm = NewStorm(batch, sensor.Config.Storm, sensor.Config.Fields, sensor.Config.FieldsUnderRoot)
+		p.out = p.storm
+	}
+	if sensor.Config.Alerts.Enabled {
+		// see "beat/alerts.go":
+		p.alerts = NewAlerts(p.out, sensor.Config.Alerts, sensor.Config.Fields, sensor.Config.FieldsUnderRoot)
+	}
+	for i := 0; i < workers; i++ {
+		p.workers.Add(1)
+		go p.decode()
+	}
+	go p.publish()
+	return p
+}
+
+// Submit queues a record, read from "source" up to "offset", to be
+// decoded and published. Once stopping, the record is dropped rather
+// than waiting for room; as it is never acknowledged the registry
+// stays behind it and it is read again on restart.
+func (p *Pipeline) Submit(source string, offset int64, record interface{}) {
+	job := &decodeJob{
+		source: source,
+		offset: offset,
+		record: record,
+		ready:  make(chan struct{}),
+	}
+	select {
+	case p.ordered <- job:
+	case <-p.stop:
+		return
+	}
+	p.work <- job
+}
+
+// Sync blocks until every record submitted has been decoded and
+// published, e.g. before the file they were read from is closed.
+// It reports false when the sensor began stopping first.
+func (p *Pipeline) Sync() bool {
+	ready := make(chan struct{})
+	close(ready)
+	job := &decodeJob{ready: ready, synced: make(chan struct{})}
+	select {
+	case p.ordered <- job:
+	case <-p.stop:
+		return false
+	}
+	select {
+	case <-job.synced:
+		return true
+	case <-p.stop:
+		return false
+	}
+}
+
+// Close publishes every record submitted and stops the goroutines,
+// waiting for at most "timeout" as publishing blocks while the output
+// is down. It reports whether everything was published.
+func (p *Pipeline) Close(timeout time.Duration) bool {
+	close(p.work)
+	close(p.ordered)
+	p.workers.Wait()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-p.published:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+func (p *Pipeline) decode() {
+	defer p.workers.Done()
+	for job := range p.work {
+		// "source" is the full path of the file being read:
+		event := p.sensor.NewFileEvent(job.source, job.offset, job.record)
+		job.event = event.ToMapStr() // see "beat/u2recordhandler.go"
+		close(job.ready)
+	}
+}
+
+func (p *Pipeline) publish() {
+	defer close(p.published)
+	for {
+		select {
+		case job, ok := <-p.ordered:
+			if !ok {
+				p.flush(true)
+				return
+			}
+			<-job.ready
+			if job.synced != nil {
+				p.flush(false)
+				close(job.synced)
+				continue
+			}
+			p.ids.Set(job.record, job.event, job.source, job.offset)
+			if p.alerts != nil {
+				p.alerts.Add(job.record, job.event, job.source, job.offset)
+				continue
+			}
+			p.out.Add(job.event, job.source, job.offset)
+		case <-time.After(p.untilDue()):
+			if p.alerts != nil {
+				p.alerts.FlushIfDue()
+			}
+			if p.storm != nil {
+				p.storm.FlushIfDue()
+			}
+			p.batch.FlushIfDue()
+		}
+	}
+}
+
+// flush publishes any alerts waiting for more records, then the batch.
+// Storm windows may span files, so only the summaries of those with
+// suppressed events are published before a file is closed, as its
+// registry state is then finished, and all of them when closing.
+func (p *Pipeline) flush(closing bool) {
+	if p.alerts != nil {
+		p.alerts.Flush()
+	}
+	if p.storm != nil {
+		if closing {
+			p.storm.Flush()
+		} else {
+			p.storm.FlushSuppressed()
+		}
+	}
+	p.batch.Flush()
+}
+
+// untilDue is how long until an alert or the batch must be published.
+func (p *Pipeline) untilDue() time.Duration {
+	due := p.batch.untilDue(spoolIdleWake)
+	if p.alerts != nil {
+		due = p.alerts.untilDue(due)
+	}
+	return due
+}
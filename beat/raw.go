@@ -0,0 +1,76 @@
+/* Copyright (c) 2016 Chris Smith
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED ``AS IS'' AND ANY EXPRESS OR IMPLIED
+ * WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package unifiedbeat
+
+import (
+	"expvar"
+	"fmt"
+
+	"github.com/cleesmith/go-unified2"
+
+	"github.com/elastic/beats/libbeat/logp"
+)
+
+// unified2 records go-unified2 could not decode, by type
+var (
+	unknownRecords     = expvar.NewMap("unifiedbeatUnknownRecords")
+	undecodableRecords = expvar.NewMap("unifiedbeatUndecodableRecords")
+)
+
+// UndecodedRecord is a unified2 record that go-unified2 could not
+// decode, when "raw_records" is set it is published as a "raw"
+// document with its type, length, file, offset and base64 data.
+type UndecodedRecord struct {
+	*unified2.RawRecord
+	Reason string // "unknown_type" or "decoding_error"
+}
+
+// unknownRecord counts a record, read up to "offset" in "source", whose
+// type is not known to go-unified2. It is returned as an UndecodedRecord
+// when "raw_records" is set, otherwise it is skipped by returning nil.
+// Any other record is returned as it is.
+func (s *Sensor) unknownRecord(source string, offset int64, record interface{}) interface{} {
+	raw, ok := record.(*unified2.RawRecord)
+	if !ok {
+		return record
+	}
+	unknownRecords.Add(fmt.Sprint(raw.Type), 1)
+	if s.Config.RawRecords {
+		return &UndecodedRecord{raw, "unknown_type"}
+	}
+	logp.Debug("unifiedbeat", "%v skipped unknown record type %v length %v ending at offset %v in '%v'",
+		s, raw.Type, len(raw.Data), offset, source)
+	return nil
+}
+
+// undecodable counts a record that failed to decode, and returns it as
+// an UndecodedRecord, go-unified2 returns the record's RawRecord along
+// with the DecodingError.
+func (s *Sensor) undecodable(raw *unified2.RawRecord) *UndecodedRecord {
+	undecodableRecords.Add(fmt.Sprint(raw.Type), 1)
+	return &UndecodedRecord{raw, "decoding_error"}
+}
@@ -0,0 +1,87 @@
+/* Copyright (c) 2016 Chris Smith
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED ``AS IS'' AND ANY EXPRESS OR IMPLIED
+ * WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package unifiedbeat
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"path/filepath"
+	"time"
+
+	"github.com/cleesmith/go-unified2"
+
+	"github.com/elastic/beats/libbeat/logp"
+)
+
+// Counts of corrupt records skipped, see the expvar web interface.
+var recoveryCounts = expvar.NewMap("unifiedbeatRecovery")
+
+type RecoveryConfig struct {
+	Enabled          bool
+	QuarantineFolder string `yaml:"quarantine_folder"`
+}
+
+// isCorrupt returns true for the errors from reader.Next that mean the
+// unified2 file is damaged. An io.ErrUnexpectedEOF is only an error
+// when a newer file exists, otherwise the sensor is still writing.
+func isCorrupt(err error) bool {
+	return err == unified2.DecodingError ||
+		err == unified2.HeaderError ||
+		err == io.ErrUnexpectedEOF
+}
+
+// recover skips over a corrupt record by scanning forward for the next
+// plausible record header, after copying the damaged file to the
+// quarantine folder (once) when one is configured.
+func (s *Sensor) recover(reader *unified2.SpoolRecordReader, cause error) error {
+	filename, offset := reader.Offset()
+
+	if s.Config.Recovery.QuarantineFolder != "" && !s.quarantined[filename] {
+		s.quarantined[filename] = true
+		quarantinePath := filepath.Join(s.Config.Recovery.QuarantineFolder,
+			fmt.Sprintf("corrupt_%v.%v", time.Now().Unix(), filepath.Base(filename)))
+		err := copyFile(filename, quarantinePath)
+		if err != nil {
+			logp.Info("recover: %v unable to quarantine '%v' err: %v", s, filename, err)
+		} else {
+			recoveryCounts.Add("quarantined", 1)
+			logp.Info("recover: %v copied corrupt file '%v' to '%v'", s, filename, quarantinePath)
+		}
+	}
+
+	skipped, err := reader.Resync()
+	if err != nil {
+		return err
+	}
+	recoveryCounts.Add("resyncs", 1)
+	recoveryCounts.Add("skipped_bytes", skipped)
+	_, resumed := reader.Offset()
+	logp.Warn("recover: %v '%v' at offset %v: %v; skipped %v bytes, resuming at offset %v",
+		s, filename, offset, cause, skipped, resumed)
+	return nil
+}
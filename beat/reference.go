@@ -0,0 +1,91 @@
+/* Copyright (c) 2016 Chris Smith
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED ``AS IS'' AND ANY EXPRESS OR IMPLIED
+ * WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package unifiedbeat
+
+import (
+	"bufio"
+	"os"
+	"strings"
+
+	"github.com/elastic/beats/libbeat/logp"
+)
+
+// LoadReferences reads the "config reference: system url_prefix" lines
+// of a reference.config file into the RuleSet, so the "reference:system,id"
+// options of rules can be expanded into URLs. As with Snort, the system
+// names are not case sensitive. Returns the number of systems read.
+func (rs *RuleSet) LoadReferences(referencePath string) (int, error) {
+	f, err := os.Open(referencePath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	rs.ReferenceSystems = make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		aline := strings.TrimSpace(scanner.Text())
+		lineNum++
+		if !strings.HasPrefix(aline, "config") {
+			continue
+		}
+		aline = strings.TrimSpace(strings.TrimPrefix(aline, "config"))
+		if !strings.HasPrefix(aline, "reference") {
+			continue
+		}
+		aline = strings.TrimSpace(strings.TrimPrefix(aline, "reference"))
+		if !strings.HasPrefix(aline, ":") {
+			continue
+		}
+		words := strings.Fields(aline[1:])
+		if len(words) < 2 {
+			logp.Info("LoadReferences: ignoring malformed reference on line# %v from file: %v", lineNum, referencePath)
+			continue
+		}
+		rs.ReferenceSystems[strings.ToLower(words[0])] = words[1]
+	}
+	return len(rs.ReferenceSystems), scanner.Err()
+}
+
+// ReferenceURL is the URL of a rule's reference, or "" when its system
+// is not in reference.config.
+func (rs *RuleSet) ReferenceURL(reference RuleReference) string {
+	if rs == nil || reference.Id == "" {
+		return ""
+	}
+	prefix, ok := rs.ReferenceSystems[strings.ToLower(reference.System)]
+	if !ok {
+		return ""
+	}
+	// "reference:url,http://..." already is a URL:
+	lower := strings.ToLower(reference.Id)
+	if strings.HasPrefix(lower, "http://") || strings.HasPrefix(lower, "https://") {
+		return reference.Id
+	}
+	return prefix + reference.Id
+}
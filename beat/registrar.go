@@ -27,7 +27,11 @@
 package unifiedbeat
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -36,27 +40,48 @@ import (
 	"github.com/elastic/beats/libbeat/logp"
 )
 
-// Registrar should only have one entry, which
-// is the offset into the unified2 file
-// currently being tailed (if any)
+// The number of bytes at the head of a unified2 file that are hashed
+// to tell it apart from another file that reused its inode or name.
+const fingerprintLen = 1024
+
+// Registrar keeps the offset into the unified2 file
+// currently being tailed (if any), plus the state of
+// each file seen in the spool folder, keyed by device
+// and inode, so a file that was renamed, truncated or
+// replaced since it was last read is recognised
 type Registrar struct {
-	registryFile string    // path to the registry file
-	State        FileState // unified2 file name and offset
-	sync.Mutex             // lock and unlock during writes
+	registryFile string               // path to the registry file
+	State        FileState            // unified2 file name and offset
+	Files        map[string]FileState // state of each file by fileKey
+	current      string               // fileKey of State.Source
+	sync.Mutex                        // lock and unlock during writes
 }
 
 // remove the ",omitempty"s so something is written
 // to the registry file instead of just "{}"
 type FileState struct {
-	Offset int64  `json:"offset"`
-	Source string `json:"source"`
+	Offset         int64  `json:"offset"`
+	Source         string `json:"source"`
+	Device         uint64 `json:"device,omitempty"`
+	Inode          uint64 `json:"inode,omitempty"`
+	Fingerprint    string `json:"fingerprint,omitempty"`
+	FingerprintLen int64  `json:"fingerprint_length,omitempty"`
+	Finished       bool   `json:"finished,omitempty"`
+}
+
+// registry is the layout of the registry file, the current
+// file's "offset" and "source" are at the top, as they were
+// before per file states were added
+type registry struct {
+	FileState
+	Files map[string]FileState `json:"files,omitempty"`
 }
 
 func NewRegistrar(registryFile string) (*Registrar, error) {
 	r := &Registrar{
 		registryFile: registryFile,
+		Files:        make(map[string]FileState),
 	}
-
 	// Ensure we have access to write the registry file
 	// by creating, closing, and removing a test file.
 	// Of course, access could still fail in later
@@ -96,36 +121,239 @@ func NewRegistrar(registryFile string) (*Registrar, error) {
 func (r *Registrar) LoadState() {
 	if existing, e := os.Open(r.registryFile); e == nil {
 		defer existing.Close()
+		var saved registry
 		decoder := json.NewDecoder(existing)
-		decoder.Decode(&r.State)
+		if err := decoder.Decode(&saved); err != nil {
+			logp.Info("LoadState: ignoring unreadable registry file '%v' err: %v", r.registryFile, err)
+			return
+		}
+		r.State = saved.FileState
+		if saved.Files != nil {
+			r.Files = saved.Files
+		} else if r.State.Source != "" {
+			// a registry file written before per file states were kept:
+			if key := r.identify(r.State.Source, false); key != "" {
+				state := r.Files[key]
+				state.Offset = r.State.Offset
+				r.Files[key] = state
+			}
+		}
 	}
 }
 
-func (r *Registrar) WriteRegistry() error {
+// Update records the offset reached in a unified2 file.
+func (r *Registrar) Update(source string, offset int64) {
+	r.Lock()
+	defer r.Unlock()
+	if source != r.State.Source || r.current == "" {
+		r.current = r.identify(source, false)
+	}
+	r.State.Source = source
+	r.State.Offset = offset
+	if r.current != "" {
+		state := r.Files[r.current]
+		state.Source = source
+		state.Offset = offset
+		r.Files[r.current] = state
+	}
+}
+
+// StartOffset is where to start reading a unified2 file, going by its
+// device, inode and fingerprint rather than its name, so a renamed
+// file keeps its offset while truncated or replaced files start over.
+func (r *Registrar) StartOffset(filename string) int64 {
+	r.Lock()
+	defer r.Unlock()
+	id, err := statFile(filename)
+	if err != nil {
+		return 0
+	}
+	key := id.key()
+	state, found := r.Files[key]
+	if !found {
+		return 0
+	}
+	fingerprint, _, err := fingerprintFile(filename, state.FingerprintLen)
+	switch {
+	case err != nil || fingerprint != state.Fingerprint:
+		logp.Info("StartOffset: '%v' replaced the file that was '%v'; reading from the start", filename, state.Source)
+		delete(r.Files, key)
+		return 0
+	case state.Offset > id.size:
+		logp.Info("StartOffset: '%v' was truncated to %v bytes from offset %v; reading from the start", filename, id.size, state.Offset)
+		state.Offset = 0
+		state.Finished = false
+	case state.Source != filename:
+		logp.Info("StartOffset: '%v' was renamed from '%v'; reading from offset %v", filename, state.Source, state.Offset)
+	}
+	state.Source = filename
+	r.Files[key] = state
+	return state.Offset
+}
+
+// Finished marks a unified2 file as completely read, so it is skipped
+// when unifiedbeat restarts before it could be archived.
+func (r *Registrar) Finished(filename string) {
+	r.Lock()
+	defer r.Unlock()
+	key := r.current
+	if filename != r.State.Source || key == "" {
+		key = r.identify(filename, true)
+	}
+	if key == "" {
+		return
+	}
+	state := r.Files[key]
+	if id, err := statFile(filename); err == nil {
+		state.Offset = id.size
+	}
+	state.Finished = true
+	r.Files[key] = state
+}
+
+// Forget drops the state of a file once it has left the spool folder.
+func (r *Registrar) Forget(filename string) {
 	r.Lock()
 	defer r.Unlock()
-	// can't truncate a file that does not exist:
-	_, err := os.Stat(r.registryFile)
-	if os.IsExist(err) {
-		err := os.Truncate(r.registryFile, 0)
+	for key, state := range r.Files {
+		if state.Source == filename {
+			delete(r.Files, key)
+			if key == r.current {
+				r.current = ""
+			}
+		}
+	}
+}
+
+// Prune drops the states of files that are no longer in the spool
+// folder, under any name.
+func (r *Registrar) Prune(folder string) {
+	r.Lock()
+	defer r.Unlock()
+	files, err := ioutil.ReadDir(folder)
+	if err != nil {
+		return
+	}
+	present := make(map[string]bool)
+	for _, file := range files {
+		if id, err := statFile(filepath.Join(folder, file.Name())); err == nil {
+			present[id.key()] = true
+		}
+	}
+	for key, state := range r.Files {
+		if !present[key] {
+			logp.Debug("registrar", "Prune: '%v' is gone", state.Source)
+			delete(r.Files, key)
+		}
+	}
+}
+
+// identify adds the identity of filename to Files, unless present,
+// and returns its key. A state whose fingerprint no longer matches
+// belonged to a file that has since been deleted and its inode reused.
+// With refresh, a fingerprint shorter than fingerprintLen is extended
+// as the file grows. Must be called while locked.
+func (r *Registrar) identify(filename string, refresh bool) string {
+	id, err := statFile(filename)
+	if err != nil {
+		return ""
+	}
+	key := id.key()
+	state, found := r.Files[key]
+	if found && state.Source == filename && !(refresh && state.FingerprintLen < fingerprintLen) {
+		return key
+	}
+	if found {
+		fingerprint, _, err := fingerprintFile(filename, state.FingerprintLen)
 		if err != nil {
-			logp.Info("WriteRegistry: os.Truncate: err=%v\n", err)
-			return err
+			return ""
 		}
+		if fingerprint != state.Fingerprint {
+			state = FileState{}
+		}
+	}
+	fingerprint, length, err := fingerprintFile(filename, fingerprintLen)
+	if err != nil {
+		return ""
+	}
+	state.Source = filename
+	state.Device = id.device
+	state.Inode = id.inode
+	state.Fingerprint = fingerprint
+	state.FingerprintLen = length
+	r.Files[key] = state
+	return key
+}
+
+// fileID is what tells one unified2 file from another.
+type fileID struct {
+	name   string
+	device uint64
+	inode  uint64
+	size   int64
+}
+
+// key is "device:inode", or the file name where there are no inodes.
+func (id fileID) key() string {
+	if id.device == 0 && id.inode == 0 {
+		return id.name
+	}
+	return fmt.Sprintf("%v:%v", id.device, id.inode)
+}
+
+// fingerprintFile hashes up to "length" bytes from the start of a file,
+// returning the hash and the number of bytes hashed.
+func fingerprintFile(filename string, length int64) (string, int64, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	hash := sha1.New()
+	n, err := io.CopyN(hash, f, length)
+	if err != nil && err != io.EOF {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), n, nil
+}
+
+// WriteRegistry writes the registry to a temporary file and renames it
+// over the registry file, so it is never left half written.
+func (r *Registrar) WriteRegistry() error {
+	r.Lock()
+	defer r.Unlock()
+	if r.State.Source != "" {
+		// the fingerprint of a new file may still be short:
+		r.current = r.identify(r.State.Source, true)
 	}
 	// if "json.Marshal" or "ioutil.WriteFile" fail then most likely
 	// unifiedbeat does not have access to the registry file
-	jsonState, err := json.Marshal(r.State)
+	jsonState, err := json.Marshal(registry{r.State, r.Files})
 	if err != nil {
 		logp.Info("WriteRegistry: json.Marshal: err=%v\n", err)
 		return err
 	}
-	// https://golang.org/pkg/io/ioutil/#WriteFile
-	// If the file does not exist, WriteFile creates it with
-	// permissions 0644; otherwise it is truncated.
-	err = ioutil.WriteFile(r.registryFile, jsonState, 0644)
+	tempFile := r.registryFile + ".new"
+	file, err := os.OpenFile(tempFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		logp.Info("WriteRegistry: os.OpenFile: err=%v\n", err)
+		return err
+	}
+	_, err = file.Write(jsonState)
+	if err == nil {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		logp.Info("WriteRegistry: writing '%v': err=%v\n", tempFile, err)
+		os.Remove(tempFile)
+		return err
+	}
+	err = os.Rename(tempFile, r.registryFile)
 	if err != nil {
-		logp.Info("WriteRegistry: ioutil.WriteFile: err=%v\n", err)
+		logp.Info("WriteRegistry: os.Rename: err=%v\n", err)
 		return err
 	}
 
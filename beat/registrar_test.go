@@ -0,0 +1,308 @@
+/* Copyright (c) 2016 Chris Smith
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED ``AS IS'' AND ANY EXPRESS OR IMPLIED
+ * WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package unifiedbeat
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// fileBytes is size bytes of content that differs with seed.
+func fileBytes(seed byte, size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = seed + byte(i*7)
+	}
+	return data
+}
+
+func writeFile(t *testing.T, filename string, data []byte) {
+	if err := ioutil.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// reloadRegistrar writes the registry and reads it back into a new
+// Registrar, as happens when unifiedbeat restarts.
+func reloadRegistrar(t *testing.T, r *Registrar) *Registrar {
+	if err := r.WriteRegistry(); err != nil {
+		t.Fatal(err)
+	}
+	reloaded, err := NewRegistrar(r.registryFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded.LoadState()
+	return reloaded
+}
+
+func TestRegistrarStartOffset(t *testing.T) {
+	tests := []struct {
+		name     string
+		change   func(t *testing.T, folder string) string // returns the file to start reading
+		expected int64
+		kept     bool // whether the file's state is still in Files
+	}{
+		{
+			"unchanged",
+			func(t *testing.T, folder string) string {
+				return filepath.Join(folder, "snort.log.1")
+			},
+			3000, true,
+		},
+		{
+			"grown",
+			func(t *testing.T, folder string) string {
+				filename := filepath.Join(folder, "snort.log.1")
+				f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+				f.Write(fileBytes(9, 500))
+				f.Close()
+				return filename
+			},
+			3000, true,
+		},
+		{
+			"renamed",
+			func(t *testing.T, folder string) string {
+				filename := filepath.Join(folder, "snort.log.2")
+				if err := os.Rename(filepath.Join(folder, "snort.log.1"), filename); err != nil {
+					t.Fatal(err)
+				}
+				return filename
+			},
+			3000, true,
+		},
+		{
+			"truncated",
+			func(t *testing.T, folder string) string {
+				filename := filepath.Join(folder, "snort.log.1")
+				if err := os.Truncate(filename, 2000); err != nil {
+					t.Fatal(err)
+				}
+				return filename
+			},
+			0, true,
+		},
+		{
+			"replaced in place",
+			func(t *testing.T, folder string) string {
+				filename := filepath.Join(folder, "snort.log.1")
+				writeFile(t, filename, fileBytes(2, 4000))
+				return filename
+			},
+			0, false,
+		},
+		{
+			"replaced by a new file",
+			func(t *testing.T, folder string) string {
+				filename := filepath.Join(folder, "snort.log.1")
+				os.Remove(filename)
+				writeFile(t, filename, fileBytes(3, 4000))
+				return filename
+			},
+			0, false,
+		},
+		{
+			"never seen",
+			func(t *testing.T, folder string) string {
+				filename := filepath.Join(folder, "snort.log.3")
+				writeFile(t, filename, fileBytes(4, 4000))
+				return filename
+			},
+			0, false,
+		},
+		{
+			"missing",
+			func(t *testing.T, folder string) string {
+				return filepath.Join(folder, "snort.log.4")
+			},
+			0, false,
+		},
+	}
+
+	for _, test := range tests {
+		registrar, remove := testRegistrar(t)
+		folder := filepath.Dir(registrar.registryFile)
+		first := filepath.Join(folder, "snort.log.1")
+		writeFile(t, first, fileBytes(1, 4000))
+		registrar.Update(first, 3000)
+		registrar = reloadRegistrar(t, registrar)
+
+		filename := test.change(t, folder)
+		if offset := registrar.StartOffset(filename); offset != test.expected {
+			t.Errorf("%v: StartOffset=%v expected %v", test.name, offset, test.expected)
+		}
+		kept := false
+		if id, err := statFile(filename); err == nil {
+			state, found := registrar.Files[id.key()]
+			kept = found
+			if found && state.Source != filename {
+				t.Errorf("%v: the state's source is '%v' expected '%v'", test.name, state.Source, filename)
+			}
+		}
+		if kept != test.kept {
+			t.Errorf("%v: state kept=%v expected %v", test.name, kept, test.kept)
+		}
+		remove()
+	}
+}
+
+func TestRegistrarFinished(t *testing.T) {
+	registrar, remove := testRegistrar(t)
+	defer remove()
+	folder := filepath.Dir(registrar.registryFile)
+	filename := filepath.Join(folder, "snort.log.1")
+	writeFile(t, filename, fileBytes(1, 4000))
+
+	registrar.Update(filename, 1000)
+	registrar.Finished(filename)
+	registrar = reloadRegistrar(t, registrar)
+	id, err := statFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := registrar.Files[id.key()]
+	if !state.Finished || state.Offset != 4000 {
+		t.Errorf("finished=%v offset=%v expected true and 4000", state.Finished, state.Offset)
+	}
+	if offset := registrar.StartOffset(filename); offset != 4000 {
+		t.Errorf("StartOffset=%v expected 4000", offset)
+	}
+}
+
+func TestRegistrarForgetPrune(t *testing.T) {
+	registrar, remove := testRegistrar(t)
+	defer remove()
+	folder := filepath.Dir(registrar.registryFile)
+	var files []string
+	for i, name := range []string{"snort.log.1", "snort.log.2", "snort.log.3"} {
+		filename := filepath.Join(folder, name)
+		writeFile(t, filename, fileBytes(byte(i), 2000))
+		registrar.Update(filename, 100)
+		files = append(files, filename)
+	}
+	sources := func() []string {
+		var names []string
+		for _, name := range files {
+			for _, state := range registrar.Files {
+				if state.Source == name {
+					names = append(names, filepath.Base(name))
+				}
+			}
+		}
+		return names
+	}
+	if names := sources(); len(names) != 3 {
+		t.Fatalf("registered %v expected all 3 files", names)
+	}
+
+	registrar.Forget(files[0])
+	if names := sources(); !reflect.DeepEqual(names, []string{"snort.log.2", "snort.log.3"}) {
+		t.Errorf("after Forget got %v", names)
+	}
+
+	os.Remove(files[1])
+	registrar.Prune(folder)
+	if names := sources(); !reflect.DeepEqual(names, []string{"snort.log.3"}) {
+		t.Errorf("after Prune got %v", names)
+	}
+}
+
+func TestRegistrarWriteRegistry(t *testing.T) {
+	registrar, remove := testRegistrar(t)
+	defer remove()
+	folder := filepath.Dir(registrar.registryFile)
+	filename := filepath.Join(folder, "snort.log.1")
+	writeFile(t, filename, fileBytes(1, 4000))
+	registrar.Update(filename, 3000)
+
+	// a temporary file left by a crash is overwritten:
+	writeFile(t, registrar.registryFile+".new", []byte("{half written"))
+	if err := registrar.WriteRegistry(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(registrar.registryFile + ".new"); !os.IsNotExist(err) {
+		t.Errorf("the temporary file was left behind: %v", err)
+	}
+	data, err := ioutil.ReadFile(registrar.registryFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved registry
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatalf("the registry file is not valid json: %v", err)
+	}
+	if saved.Source != filename || saved.Offset != 3000 || len(saved.Files) != 1 {
+		t.Errorf("saved %+v", saved)
+	}
+
+	reloaded := reloadRegistrar(t, registrar)
+	if reloaded.State != registrar.State || !reflect.DeepEqual(reloaded.Files, registrar.Files) {
+		t.Errorf("reloaded %+v %+v expected %+v %+v", reloaded.State, reloaded.Files, registrar.State, registrar.Files)
+	}
+
+	// a write that fails leaves the registry file as it was:
+	os.Remove(registrar.registryFile + ".new")
+	if err := os.Mkdir(registrar.registryFile+".new", 0755); err != nil {
+		t.Fatal(err)
+	}
+	registrar.Update(filename, 3500)
+	if err := registrar.WriteRegistry(); err == nil {
+		t.Error("WriteRegistry succeeded writing over a folder")
+	}
+	after, err := ioutil.ReadFile(registrar.registryFile)
+	if err != nil || string(after) != string(data) {
+		t.Errorf("the registry file changed after a failed write: %s", after)
+	}
+}
+
+// A registry written before per file states were kept still gives the
+// file's offset.
+func TestRegistrarLoadOldState(t *testing.T) {
+	registrar, remove := testRegistrar(t)
+	defer remove()
+	folder := filepath.Dir(registrar.registryFile)
+	filename := filepath.Join(folder, "snort.log.1")
+	writeFile(t, filename, fileBytes(1, 4000))
+	old, _ := json.Marshal(map[string]interface{}{"offset": 1234, "source": filename})
+	writeFile(t, registrar.registryFile, old)
+
+	registrar.LoadState()
+	if registrar.State.Source != filename || registrar.State.Offset != 1234 {
+		t.Errorf("loaded %+v", registrar.State)
+	}
+	if offset := registrar.StartOffset(filename); offset != 1234 {
+		t.Errorf("StartOffset=%v expected 1234", offset)
+	}
+}
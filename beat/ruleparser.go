@@ -0,0 +1,338 @@
+/* Copyright (c) 2016 Chris Smith
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED ``AS IS'' AND ANY EXPRESS OR IMPLIED
+ * WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package unifiedbeat
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/elastic/beats/libbeat/common"
+)
+
+// RuleReference is a "reference:system,id;" option of a rule.
+type RuleReference struct {
+	System string
+	Id     string
+}
+
+// RuleMatch is a "content" or "pcre" option of a rule, with the content
+// modifiers (nocase, depth:4, http_uri ...) that follow it.
+type RuleMatch struct {
+	Keyword   string
+	Value     string
+	Negated   bool
+	Modifiers []string
+}
+
+// RuleOption is one "keyword:value;" or "keyword;" in the body of a rule.
+type RuleOption struct {
+	Keyword string
+	Value   string
+}
+
+// ParsedRule is a Snort rule taken apart, as in:
+//
+//	action protocol src_nets src_ports direction dst_nets dst_ports (options)
+type ParsedRule struct {
+	Action     string
+	Protocol   string
+	SrcNets    string
+	SrcPorts   string
+	Direction  string
+	DstNets    string
+	DstPorts   string
+	Gid        string
+	Sid        string
+	Msg        string
+	Rev        int
+	Classtype  string
+	Priority   int
+	References []RuleReference
+	Metadata   []string
+	Flowbits   []string
+	Matches    []RuleMatch
+}
+
+// the options that modify the content or pcre option before them
+var contentModifiers = map[string]bool{
+	"nocase":           true,
+	"rawbytes":         true,
+	"depth":            true,
+	"offset":           true,
+	"distance":         true,
+	"within":           true,
+	"fast_pattern":     true,
+	"http_client_body": true,
+	"http_cookie":      true,
+	"http_raw_cookie":  true,
+	"http_header":      true,
+	"http_raw_header":  true,
+	"http_method":      true,
+	"http_uri":         true,
+	"http_raw_uri":     true,
+	"http_stat_code":   true,
+	"http_stat_msg":    true,
+	"http_encode":      true,
+	"startswith":       true,
+	"endswith":         true,
+	"replace":          true,
+}
+
+// ParseRule takes apart one rule, already joined into a single line,
+// returning false when it has no options in parentheses. As Snort does,
+// a rule without a "gid" option has gid 1.
+func ParseRule(text string) (ParsedRule, bool) {
+	var rule ParsedRule
+	open := strings.Index(text, "(")
+	close := strings.LastIndex(text, ")")
+	if open < 0 || close < open {
+		return rule, false
+	}
+	header := splitRuleHeader(text[:open])
+	fields := []*string{&rule.Action, &rule.Protocol, &rule.SrcNets, &rule.SrcPorts, &rule.Direction, &rule.DstNets, &rule.DstPorts}
+	for i, field := range header {
+		if i >= len(fields) {
+			break
+		}
+		*fields[i] = field
+	}
+
+	rule.Gid = "1"
+	var match *RuleMatch
+	for _, option := range splitRuleOptions(text[open+1 : close]) {
+		switch option.Keyword {
+		case "gid":
+			rule.Gid = option.Value
+		case "sid":
+			rule.Sid = option.Value
+		case "msg":
+			rule.Msg = unquoteRuleValue(option.Value)
+		case "rev":
+			rule.Rev, _ = strconv.Atoi(option.Value)
+		case "classtype":
+			rule.Classtype = option.Value
+		case "priority":
+			rule.Priority, _ = strconv.Atoi(option.Value)
+		case "reference":
+			parts := strings.SplitN(option.Value, ",", 2)
+			reference := RuleReference{System: strings.TrimSpace(parts[0])}
+			if len(parts) > 1 {
+				reference.Id = strings.TrimSpace(parts[1])
+			}
+			rule.References = append(rule.References, reference)
+		case "metadata":
+			for _, item := range strings.Split(option.Value, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					rule.Metadata = append(rule.Metadata, item)
+				}
+			}
+		case "flowbits":
+			rule.Flowbits = append(rule.Flowbits, option.Value)
+		case "content", "uricontent", "pcre":
+			value := option.Value
+			negated := strings.HasPrefix(value, "!")
+			if negated {
+				value = strings.TrimSpace(value[1:])
+			}
+			rule.Matches = append(rule.Matches, RuleMatch{Keyword: option.Keyword, Value: unquoteRuleValue(value), Negated: negated})
+			match = &rule.Matches[len(rule.Matches)-1]
+			continue
+		default:
+			if match != nil && contentModifiers[option.Keyword] {
+				modifier := option.Keyword
+				if option.Value != "" {
+					modifier += ":" + option.Value
+				}
+				match.Modifiers = append(match.Modifiers, modifier)
+				continue
+			}
+		}
+		match = nil
+	}
+	return rule, true
+}
+
+// splitRuleHeader splits the part of a rule before its options on
+// spaces, except those inside of a [list] of networks or ports.
+func splitRuleHeader(header string) []string {
+	var fields []string
+	depth := 0
+	start := -1
+	for i, c := range header {
+		switch {
+		case c == '[':
+			depth++
+		case c == ']' && depth > 0:
+			depth--
+		case unicode.IsSpace(c) && depth == 0:
+			if start >= 0 {
+				fields = append(fields, header[start:i])
+				start = -1
+			}
+			continue
+		}
+		if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		fields = append(fields, header[start:])
+	}
+	return fields
+}
+
+// splitRuleOptions splits the options of a rule on the semicolons that
+// are not escaped with a backslash or inside of quotes.
+func splitRuleOptions(body string) []RuleOption {
+	var options []RuleOption
+	quoted := false
+	escaped := false
+	start := 0
+	for i, c := range body {
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case c == ';' && !quoted:
+			if option, ok := newRuleOption(body[start:i]); ok {
+				options = append(options, option)
+			}
+			start = i + 1
+		}
+	}
+	if option, ok := newRuleOption(body[start:]); ok {
+		options = append(options, option)
+	}
+	return options
+}
+
+func newRuleOption(text string) (RuleOption, bool) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return RuleOption{}, false
+	}
+	colon := strings.Index(text, ":")
+	if colon < 0 {
+		return RuleOption{Keyword: text}, true
+	}
+	return RuleOption{
+		Keyword: strings.TrimSpace(text[:colon]),
+		Value:   strings.TrimSpace(text[colon+1:]),
+	}, true
+}
+
+// unquoteRuleValue removes the quotes around an option's value and the
+// backslashes escaping quotes, semicolons and backslashes inside it.
+func unquoteRuleValue(value string) string {
+	if len(value) >= 2 && strings.HasPrefix(value, `"`) && strings.HasSuffix(value, `"`) {
+		value = value[1 : len(value)-1]
+	}
+	if !strings.Contains(value, `\`) {
+		return value
+	}
+	unquoted := make([]byte, 0, len(value))
+	for i := 0; i < len(value); i++ {
+		if value[i] == '\\' && i+1 < len(value) && strings.IndexByte(`";\:`, value[i+1]) >= 0 {
+			i++
+		}
+		unquoted = append(unquoted, value[i])
+	}
+	return string(unquoted)
+}
+
+// addFields adds the parts of a rule to an event as rule_* fields,
+// leaving out those the rule does not have. The references get their
+// URLs from the reference.config of rs, and the CVE ids are also put
+// in rule_cve.
+func (rule *ParsedRule) addFields(event common.MapStr, rs *RuleSet) {
+	strs := map[string]string{
+		"rule_action":    rule.Action,
+		"rule_protocol":  rule.Protocol,
+		"rule_src_nets":  rule.SrcNets,
+		"rule_src_ports": rule.SrcPorts,
+		"rule_direction": rule.Direction,
+		"rule_dst_nets":  rule.DstNets,
+		"rule_dst_ports": rule.DstPorts,
+		"rule_classtype": rule.Classtype,
+	}
+	for name, value := range strs {
+		if value != "" {
+			event[name] = value
+		}
+	}
+	if rule.Rev != 0 {
+		event["rule_rev"] = rule.Rev
+	}
+	if rule.Priority != 0 {
+		event["rule_priority"] = rule.Priority
+	}
+	if len(rule.References) > 0 {
+		references := make([]common.MapStr, len(rule.References))
+		var cves []string
+		for i, reference := range rule.References {
+			references[i] = common.MapStr{"system": reference.System, "id": reference.Id}
+			if url := rs.ReferenceURL(reference); url != "" {
+				references[i]["url"] = url
+			}
+			if strings.EqualFold(reference.System, "cve") && reference.Id != "" {
+				cve := strings.ToUpper(reference.Id)
+				if !strings.HasPrefix(cve, "CVE-") {
+					cve = "CVE-" + cve
+				}
+				cves = append(cves, cve)
+			}
+		}
+		event["rule_references"] = references
+		if len(cves) > 0 {
+			event["rule_cve"] = cves
+		}
+	}
+	if len(rule.Metadata) > 0 {
+		event["rule_metadata"] = rule.Metadata
+	}
+	if len(rule.Flowbits) > 0 {
+		event["rule_flowbits"] = rule.Flowbits
+	}
+	if len(rule.Matches) > 0 {
+		matches := make([]common.MapStr, len(rule.Matches))
+		for i, match := range rule.Matches {
+			matches[i] = common.MapStr{
+				"keyword": match.Keyword,
+				"value":   match.Value,
+				"negated": match.Negated,
+			}
+			if len(match.Modifiers) > 0 {
+				matches[i]["modifiers"] = match.Modifiers
+			}
+		}
+		event["rule_matches"] = matches
+	}
+}
@@ -0,0 +1,149 @@
+/* Copyright (c) 2016 Chris Smith
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED ``AS IS'' AND ANY EXPRESS OR IMPLIED
+ * WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package unifiedbeat
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitRuleOptions(t *testing.T) {
+	tests := []struct {
+		body     string
+		expected []RuleOption
+	}{
+		{
+			`msg:"plain"; sid:1;`,
+			[]RuleOption{{"msg", `"plain"`}, {"sid", "1"}},
+		},
+		{
+			// semicolons inside quotes don't end an option:
+			`msg:"one; two"; content:"a;b"; sid:2`,
+			[]RuleOption{{"msg", `"one; two"`}, {"content", `"a;b"`}, {"sid", "2"}},
+		},
+		{
+			// nor do escaped quotes end the quotes:
+			`content:"say \"hi;\""; nocase;`,
+			[]RuleOption{{"content", `"say \"hi;\""`}, {"nocase", ""}},
+		},
+		{
+			// an escaped semicolon outside of quotes:
+			`pcre:/a\;b/i; rev:3;`,
+			[]RuleOption{{"pcre", `/a\;b/i`}, {"rev", "3"}},
+		},
+		{
+			// the value is everything after the first colon:
+			`  reference : url,example.com:8080/x ;;  `,
+			[]RuleOption{{"reference", "url,example.com:8080/x"}},
+		},
+		{
+			``,
+			nil,
+		},
+	}
+
+	for _, test := range tests {
+		options := splitRuleOptions(test.body)
+		if !reflect.DeepEqual(options, test.expected) {
+			t.Errorf("splitRuleOptions(%q) = %#v, expected %#v", test.body, options, test.expected)
+		}
+	}
+}
+
+func TestUnquoteRuleValue(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected string
+	}{
+		{`"plain"`, `plain`},
+		{`"say \"hi\""`, `say "hi"`},
+		{`"a\;b\:c\\d"`, `a;b:c\d`},
+		{`"|3B| \x"`, `|3B| \x`},
+		{`unquoted`, `unquoted`},
+		{`"`, `"`},
+	}
+
+	for _, test := range tests {
+		if unquoted := unquoteRuleValue(test.value); unquoted != test.expected {
+			t.Errorf("unquoteRuleValue(%q) = %q, expected %q", test.value, unquoted, test.expected)
+		}
+	}
+}
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		text     string
+		ok       bool
+		expected ParsedRule
+	}{
+		{
+			`alert tcp $EXTERNAL_NET any -> $HOME_NET 21 (msg:"FTP SITE EXEC; format string"; flow:to_server,established; content:"SITE"; nocase; content:"EXEC"; distance:0; nocase; pcre:"/^SITE\s+EXEC\s[^\n]*?%[^\n]*?%/smi"; reference:bugtraq,1387; reference:cve,2000-0573; classtype:bad-unknown; sid:1971; rev:4;)`,
+			true,
+			ParsedRule{
+				Action: "alert", Protocol: "tcp", SrcNets: "$EXTERNAL_NET", SrcPorts: "any",
+				Direction: "->", DstNets: "$HOME_NET", DstPorts: "21",
+				Gid: "1", Sid: "1971", Msg: "FTP SITE EXEC; format string", Rev: 4, Classtype: "bad-unknown",
+				References: []RuleReference{{"bugtraq", "1387"}, {"cve", "2000-0573"}},
+				Matches: []RuleMatch{
+					{"content", "SITE", false, []string{"nocase"}},
+					{"content", "EXEC", false, []string{"distance:0", "nocase"}},
+					{"pcre", `/^SITE\s+EXEC\s[^\n]*?%[^\n]*?%/smi`, false, nil},
+				},
+			},
+		},
+		{
+			// escaped quotes and semicolons in content, a negated
+			// content, lists with spaces in the header and a gid:
+			`drop udp [10.0.0.0/8, 192.168.0.0/16] any <> any [53, 5353] (msg:"quote \" semi \;"; content:!"a\"b\;c"; depth:4; gid:3; sid:100; rev:1; priority:2; metadata:policy balanced-ips drop, service dns; flowbits:set,dns.q; flowbits:noalert;)`,
+			true,
+			ParsedRule{
+				Action: "drop", Protocol: "udp", SrcNets: "[10.0.0.0/8, 192.168.0.0/16]", SrcPorts: "any",
+				Direction: "<>", DstNets: "any", DstPorts: "[53, 5353]",
+				Gid: "3", Sid: "100", Msg: `quote " semi ;`, Rev: 1, Priority: 2,
+				Metadata: []string{"policy balanced-ips drop", "service dns"},
+				Flowbits: []string{"set,dns.q", "noalert"},
+				Matches:  []RuleMatch{{"content", `a"b;c`, true, []string{"depth:4"}}},
+			},
+		},
+		{
+			`alert tcp any any -> any any`,
+			false,
+			ParsedRule{},
+		},
+	}
+
+	for _, test := range tests {
+		rule, ok := ParseRule(test.text)
+		if ok != test.ok {
+			t.Errorf("ParseRule(%q) returned %v, expected %v", test.text, ok, test.ok)
+			continue
+		}
+		if !reflect.DeepEqual(rule, test.expected) {
+			t.Errorf("ParseRule(%q) =\n%#v\nexpected\n%#v", test.text, rule, test.expected)
+		}
+	}
+}
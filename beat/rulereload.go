@@ -0,0 +1,362 @@
+/* Copyright (c) 2016 Chris Smith
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED ``AS IS'' AND ANY EXPRESS OR IMPLIED
+ * WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package unifiedbeat
+
+import (
+	"expvar"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/elastic/beats/libbeat/logp"
+)
+
+// Counts of rule reloads, see the expvar web interface (-httpprof).
+var ruleCounts = expvar.NewMap("unifiedbeatRules")
+
+// RuleLoader holds the RuleSet loaded for one rules setting of
+// unifiedbeat.yml, shared by the sensors with that setting. When
+// reloaded, on SIGHUP or when "watch" sees the files change, the new
+// RuleSet is read in the background and swapped in as a whole, so a
+// FileEvent (and its ToMapStr) always has a complete RuleSet.
+type RuleLoader struct {
+	config  RulesConfig
+	sensors []string     // names of the sensors using these rules
+	ruleSet atomic.Value // *RuleSet
+	state   string       // fileState of the files ruleSet was read from
+
+	// publish, when set, sends the summary document of each reload:
+	publish  func(common.MapStr)
+	reloads  chan struct{}
+	changes  chan struct{}
+	watchers []SpoolWatcher
+	quit     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// NewRuleLoader loads the rules, classifications and references of a
+// rules setting, logging the stats for "sensor".
+func NewRuleLoader(config RulesConfig, sensor *Sensor) (*RuleLoader, error) {
+	l := &RuleLoader{
+		config:  config,
+		sensors: []string{sensor.Name},
+		reloads: make(chan struct{}, 1),
+		changes: make(chan struct{}, 1),
+		quit:    make(chan struct{}),
+	}
+	state := l.fileState()
+	ruleSet, err := l.load()
+	if err != nil {
+		return nil, err
+	}
+	l.ruleSet.Store(ruleSet)
+	l.state = state
+	return l, nil
+}
+
+// RuleSet is the current RuleSet, which is never changed once loaded.
+func (l *RuleLoader) RuleSet() *RuleSet {
+	return l.ruleSet.Load().(*RuleSet)
+}
+
+// load reads a new RuleSet from the files of the rules setting.
+func (l *RuleLoader) load() (*RuleSet, error) {
+	ruleSet, multipleLineRules, duplicateRuleWarnings, err := LoadRules(l.config.GenMsgMapPath, l.config.Paths)
+	if err != nil {
+		return nil, err
+	}
+	logp.Info("RuleLoader: %v Rules warnings: %v duplicate rules rejected", l, duplicateRuleWarnings)
+	logp.Info("RuleLoader: %v Rules stats: %v rule files read, %v rules created, %v of them multiple line rules", l, len(ruleSet.SourceFiles), len(ruleSet.Rules), multipleLineRules)
+	if l.config.ClassificationPath != "" {
+		duplicateWarnings, err := ruleSet.LoadClassifications(l.config.ClassificationPath)
+		if err != nil {
+			return nil, fmt.Errorf("loading 'classification_path' error: %v", err)
+		}
+		logp.Info("RuleLoader: %v Classifications stats: %v classifications created, %v duplicates rejected", l, len(ruleSet.Classifications), duplicateWarnings)
+	}
+	if l.config.ReferencePath != "" {
+		systems, err := ruleSet.LoadReferences(l.config.ReferencePath)
+		if err != nil {
+			return nil, fmt.Errorf("loading 'reference_path' error: %v", err)
+		}
+		logp.Info("RuleLoader: %v References stats: %v reference systems read", l, systems)
+	}
+	if len(l.config.HistoryPaths) > 0 {
+		revisions, err := ruleSet.LoadHistory(l.config.HistoryPaths)
+		if err != nil {
+			return nil, fmt.Errorf("loading 'history_paths' error: %v", err)
+		}
+		logp.Info("RuleLoader: %v History stats: %v older rule revisions read", l, revisions)
+	}
+	return ruleSet, nil
+}
+
+// Reload asks for the rules to be read again, even if their files
+// seem unchanged, e.g. on SIGHUP. It never blocks.
+func (l *RuleLoader) Reload() {
+	select {
+	case l.reloads <- struct{}{}:
+	default:
+	}
+}
+
+// Start reloads the rules in the background when asked to by Reload
+// and, with "watch", when their files change. The summary of each
+// reload is passed to "publish".
+func (l *RuleLoader) Start(publish func(common.MapStr)) {
+	l.publish = publish
+	if l.config.Watch {
+		// without inotify the folders are polled every watch_delay:
+		for _, folder := range l.folders() {
+			watcher, err := NewSpoolWatcher(folder, "", "auto", l.watchDelay())
+			if err != nil {
+				logp.Warn("RuleLoader: %v unable to watch folder '%v' error: %v", l, folder, err)
+				continue
+			}
+			l.watchers = append(l.watchers, watcher)
+			l.wg.Add(1)
+			go l.forward(watcher)
+		}
+	}
+	l.wg.Add(1)
+	go l.run()
+}
+
+// watchDelay is how long rule files must be left alone before they
+// are reloaded.
+func (l *RuleLoader) watchDelay() time.Duration {
+	if l.config.WatchDelay > 0 {
+		return time.Duration(l.config.WatchDelay) * time.Second
+	}
+	return time.Duration(5) * time.Second // default is 5 seconds
+}
+
+// forward passes the changes of one watched folder on to run.
+func (l *RuleLoader) forward(watcher SpoolWatcher) {
+	defer l.wg.Done()
+	for {
+		select {
+		case <-l.quit:
+			return
+		case <-watcher.Changes():
+			select {
+			case l.changes <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+func (l *RuleLoader) run() {
+	defer l.wg.Done()
+	delay := l.watchDelay()
+	for {
+		select {
+		case <-l.quit:
+			return
+		case <-l.reloads:
+			logp.Info("RuleLoader: %v reloading rules as requested", l)
+			l.reload(l.fileState())
+		case <-l.changes:
+			// rule updates (e.g. by pulledpork) rewrite many files,
+			// so wait until they have been left alone for "delay":
+			quiet := time.NewTimer(delay)
+		waiting:
+			for {
+				select {
+				case <-l.quit:
+					quiet.Stop()
+					return
+				case <-l.changes:
+					quiet.Reset(delay)
+				case <-quiet.C:
+					break waiting
+				}
+			}
+			state := l.fileState()
+			if state == l.state {
+				logp.Debug("rules", "RuleLoader: %v rule files are unchanged", l)
+				continue
+			}
+			logp.Info("RuleLoader: %v rule files changed; reloading rules", l)
+			l.reload(state)
+		}
+	}
+}
+
+// reload reads a new RuleSet and swaps it for the current one, unless
+// it fails to load, then logs and publishes what changed.
+func (l *RuleLoader) reload(state string) {
+	start := time.Now()
+	ruleSet, err := l.load()
+	if err != nil {
+		ruleCounts.Add("reload_errors", 1)
+		logp.Err("RuleLoader: %v reloading rules failed, still using the previous rules; error: %v", l, err)
+		return
+	}
+	previous := l.RuleSet()
+	// events written before the update may still have the old revisions:
+	kept := ruleSet.keepRevisions(previous, l.config.KeepRevisions)
+	l.ruleSet.Store(ruleSet)
+	l.state = state
+	ruleCounts.Add("reloads", 1)
+
+	added, removed, changed := diffRuleSets(previous, ruleSet)
+	logp.Info("RuleLoader: %v reloaded %v rules in %v: %v added, %v removed, %v changed; %v older revisions kept",
+		l, len(ruleSet.Rules), time.Since(start), len(added), len(removed), len(changed), kept)
+	logp.Debug("rules", "RuleLoader: %v added: %v removed: %v changed: %v", l, added, removed, changed)
+	if l.publish == nil {
+		return
+	}
+	summary := common.MapStr{
+		"@timestamp":          common.Time(time.Now()),
+		"type":                "rules_reload",
+		"rules_count":         len(ruleSet.Rules),
+		"rules_added":         added,
+		"rules_added_count":   len(added),
+		"rules_removed":       removed,
+		"rules_removed_count": len(removed),
+		"rules_changed":       changed,
+		"rules_changed_count": len(changed),
+	}
+	if l.sensors[0] != "" {
+		summary["sensors"] = l.sensors
+	}
+	l.publish(summary)
+}
+
+// diffRuleSets returns the "gid:sid"s of the rules only in next, only
+// in previous, and in both but with a different rule.
+func diffRuleSets(previous, next *RuleSet) ([]string, []string, []string) {
+	added := []string{}
+	removed := []string{}
+	changed := []string{}
+	for gidSid, rule := range next.Rules {
+		previousRule, found := previous.Rules[gidSid]
+		switch {
+		case !found:
+			added = append(added, gidSid)
+		case previousRule.RuleRaw != rule.RuleRaw || previousRule.Msg != rule.Msg:
+			changed = append(changed, gidSid)
+		}
+	}
+	for gidSid := range previous.Rules {
+		if _, found := next.Rules[gidSid]; !found {
+			removed = append(removed, gidSid)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	sort.Strings(changed)
+	return added, removed, changed
+}
+
+// files lists gen-msg.map, classification.config, reference.config,
+// the rule files and the history rule files.
+func (l *RuleLoader) files() []string {
+	files := []string{l.config.GenMsgMapPath}
+	if l.config.ClassificationPath != "" {
+		files = append(files, l.config.ClassificationPath)
+	}
+	if l.config.ReferencePath != "" {
+		files = append(files, l.config.ReferencePath)
+	}
+	ruleFiles, _ := globRuleFiles(l.config.Paths)
+	historyFiles, _ := globRuleFiles(l.config.HistoryPaths)
+	files = append(files, ruleFiles...)
+	return append(files, historyFiles...)
+}
+
+// fileState is the name, size and modification time of each file, to
+// tell whether any of them changed.
+func (l *RuleLoader) fileState() string {
+	var state []string
+	for _, file := range l.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			state = append(state, file)
+			continue
+		}
+		state = append(state, fmt.Sprintf("%v:%v:%v", file, info.Size(), info.ModTime().UnixNano()))
+	}
+	return strings.Join(state, "|")
+}
+
+// folders are those holding the files, and the folders of the rules
+// paths, where new rule files may appear.
+func (l *RuleLoader) folders() []string {
+	seen := make(map[string]bool)
+	var folders []string
+	add := func(folder string) {
+		if absPath, err := filepath.Abs(folder); err == nil {
+			folder = absPath
+		}
+		if info, err := os.Stat(folder); err != nil || !info.IsDir() || seen[folder] {
+			return
+		}
+		seen[folder] = true
+		folders = append(folders, folder)
+	}
+	for _, file := range l.files() {
+		add(filepath.Dir(file))
+	}
+	for _, paths := range [][]string{l.config.Paths, l.config.HistoryPaths} {
+		for _, apath := range paths {
+			add(apath)
+			add(filepath.Dir(apath))
+		}
+	}
+	return folders
+}
+
+// Close stops reloading the rules.
+func (l *RuleLoader) Close() {
+	select {
+	case <-l.quit:
+		return
+	default:
+	}
+	close(l.quit)
+	for _, watcher := range l.watchers {
+		watcher.Close()
+	}
+	l.wg.Wait()
+}
+
+// String is used to tell rule loaders apart in log messages.
+func (l *RuleLoader) String() string {
+	if len(l.sensors) == 1 && l.sensors[0] == "" {
+		return "sensor"
+	}
+	return "sensor(s) '" + strings.Join(l.sensors, "', '") + "'"
+}
@@ -28,10 +28,13 @@ package unifiedbeat
 
 import (
 	"bufio"
+	"fmt"
 	"os"
 	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/elastic/beats/libbeat/logp"
@@ -44,55 +47,257 @@ type Rule struct {
 	Sid               string
 	Msg               string
 	RuleRaw           string
+	Parsed            *ParsedRule // nil for the rules in gen-msg.map
 }
 
-var SourceFiles []string
+// RuleSet holds the Rules of one sensor, keyed by "gid:sid", every
+// revision of those rules seen, keyed by "gid:sid:rev", the files they
+// were read from, the Classifications, if any, by id and the URL
+// prefixes of the reference systems, if any, by system name.
+// Sensors with the same rules settings in unifiedbeat.yml share a RuleSet.
+type RuleSet struct {
+	SourceFiles      []string
+	Rules            map[string]Rule
+	Revisions        map[string]Rule
+	Classifications  []Classification
+	ReferenceSystems map[string]string
+}
 
-var Rules = make(map[string]Rule)
+func NewRuleSet() *RuleSet {
+	return &RuleSet{
+		Rules:     make(map[string]Rule),
+		Revisions: make(map[string]Rule),
+	}
+}
 
-func LoadRules(genMsgMapPath string, rulePaths []string) (int, int, error) {
-	multipleLineWarnings := 0
-	duplicateRuleWarnings := 0
+// the actions that start a rule:
+var matchRuleActions = regexp.MustCompile(`^alert|^log|^pass|^activate|^dynamic|^drop|^reject|^sdrop`)
 
-	duplicateRuleWarnings, err := loadGenMsgMap(genMsgMapPath)
+// Lookup returns the Rule for a generator and signature id.
+func (rs *RuleSet) Lookup(gid, sid uint32) (Rule, bool) {
+	if rs == nil {
+		return Rule{}, false
+	}
+	aRule, ok := rs.Rules[fmt.Sprint(gid)+":"+fmt.Sprint(sid)]
+	return aRule, ok
+}
 
-	backslash := `\` // indicates a multiple line snort rule to be ignored
+// LookupRevision returns the Rule with the revision of an event, when
+// that revision was seen, otherwise the Rule for the generator and
+// signature id. The last result is whether the revision was found.
+func (rs *RuleSet) LookupRevision(gid, sid, rev uint32) (Rule, bool, bool) {
+	if rs == nil {
+		return Rule{}, false, false
+	}
+	gidSid := fmt.Sprint(gid) + ":" + fmt.Sprint(sid)
+	if aRule, ok := rs.Revisions[gidSid+":"+fmt.Sprint(rev)]; ok {
+		return aRule, true, true
+	}
+	aRule, ok := rs.Rules[gidSid]
+	return aRule, ok, false
+}
 
-	defaultGid := "1"
+// LoadRules reads gen-msg.map and the rule files, returning the Rules
+// with the number of multiple line rules read and of duplicate rules
+// rejected.
+func LoadRules(genMsgMapPath string, rulePaths []string) (*RuleSet, int, int, error) {
+	rs := NewRuleSet()
+	multipleLineRules := 0
+	duplicateRuleWarnings := 0
 
-	ruleActionsRegexp := `^alert|^log|^pass|^activate|^dynamic|^drop|^reject|^sdrop`
-	ruleSidRegexp := `sid\s*:\s*(\d+);`
-	ruleGidRegexp := `gid\s*:\s*(\d+);`
-	ruleMsgRegexp := `msg\s*:\s*\"(.*?)\";`
+	duplicateRuleWarnings, err := rs.loadGenMsgMap(genMsgMapPath)
 
-	matchRuleActions, err := regexp.Compile(ruleActionsRegexp)
+	ruleFileNames, err := globRuleFiles(rulePaths)
 	if err != nil {
-		return 0, 0, err
+		return nil, 0, 0, err
 	}
 
-	matchRuleSid, err := regexp.Compile(ruleSidRegexp)
-	if err != nil {
-		return 0, 0, err
+	// process each rule file:
+	for _, filename := range ruleFileNames {
+		multipleLines, duplicates, err := rs.loadRuleFile(filename, false)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+		multipleLineRules += multipleLines
+		duplicateRuleWarnings += duplicates
 	}
+	return rs, multipleLineRules, duplicateRuleWarnings, err
+}
 
-	matchRuleGid, err := regexp.Compile(ruleGidRegexp)
+// LoadHistory reads the rule files of historyPaths, e.g. the rules
+// before the last few pulledpork updates, for their revisions only.
+// Returns the number of revisions added.
+func (rs *RuleSet) LoadHistory(historyPaths []string) (int, error) {
+	ruleFileNames, err := globRuleFiles(historyPaths)
 	if err != nil {
-		return 0, 0, err
+		return 0, err
+	}
+	revisions := len(rs.Revisions)
+	for _, filename := range ruleFileNames {
+		if _, _, err := rs.loadRuleFile(filename, true); err != nil {
+			return 0, err
+		}
+	}
+	return len(rs.Revisions) - revisions, nil
+}
+
+// keepRevisions adds the revisions of a previous RuleSet that are not in
+// this one, so after a reload the events written before a rule was
+// updated still find their revision. With a limit above 0 only the
+// newest are kept, up to limit for each gid:sid counting those read from
+// the rule and history files, which are always kept. Returns the number
+// kept.
+func (rs *RuleSet) keepRevisions(previous *RuleSet, limit int) int {
+	loaded := make(map[string]int)
+	for gidSidRev := range rs.Revisions {
+		loaded[gidSidRev[:strings.LastIndex(gidSidRev, ":")]]++
+	}
+	older := make(map[string][]int)
+	for gidSidRev := range previous.Revisions {
+		if _, found := rs.Revisions[gidSidRev]; found {
+			continue
+		}
+		colon := strings.LastIndex(gidSidRev, ":")
+		rev, err := strconv.Atoi(gidSidRev[colon+1:])
+		if err != nil {
+			continue
+		}
+		older[gidSidRev[:colon]] = append(older[gidSidRev[:colon]], rev)
+	}
+
+	sourceFileIndexes := make(map[string]int)
+	for i, sourceFile := range rs.SourceFiles {
+		sourceFileIndexes[sourceFile] = i
+	}
+	kept := 0
+	for gidSid, revs := range older {
+		sort.Sort(sort.Reverse(sort.IntSlice(revs)))
+		keep := len(revs)
+		if limit > 0 {
+			keep = limit - loaded[gidSid]
+		}
+		for i := 0; i < keep && i < len(revs); i++ {
+			gidSidRev := gidSid + ":" + strconv.Itoa(revs[i])
+			aRule := previous.Revisions[gidSidRev]
+			sourceFile := previous.SourceFiles[aRule.SourceFileIndex]
+			sourceFileIndex, found := sourceFileIndexes[sourceFile]
+			if !found {
+				rs.SourceFiles = append(rs.SourceFiles, sourceFile)
+				sourceFileIndex = len(rs.SourceFiles) - 1
+				sourceFileIndexes[sourceFile] = sourceFileIndex
+			}
+			aRule.SourceFileIndex = sourceFileIndex
+			rs.Revisions[gidSidRev] = aRule
+			kept++
+		}
 	}
+	return kept
+}
+
+// loadRuleFile adds the rules of one file to Rules and Revisions, or
+// with "history" only to Revisions. Returns the number of multiple line
+// rules read and of duplicate rules rejected.
+func (rs *RuleSet) loadRuleFile(filename string, history bool) (int, int, error) {
+	multipleLineRules := 0
+	duplicateRuleWarnings := 0
 
-	matchRuleMsg, err := regexp.Compile(ruleMsgRegexp)
+	backslash := `\` // indicates a multiple line snort rule
+
+	aFile, err := os.Open(filename)
 	if err != nil {
 		return 0, 0, err
 	}
+	defer aFile.Close()
+	// avoid duplicating path and filename's for each rule (less memory)
+	rs.SourceFiles = append(rs.SourceFiles, aFile.Name())
+	sourceFileIndex := len(rs.SourceFiles) - 1
+
+	scanner := bufio.NewScanner(aFile)
+	lineNum := 0
+	for scanner.Scan() {
+		line := scanner.Text()
+		aline := strings.TrimSpace(line)
+		lineNum++
+		if len(aline) <= 0 {
+			continue
+		}
+		matchedRuleAction := matchRuleActions.MatchString(aline)
+		if matchedRuleAction {
+			// a backslash "\" at the end of a line continues the rule on the
+			// next line; as Snort does, the lines are joined without the
+			// backslashes to parse the rule, while the rule's
+			// RuleRaw keeps the lines as they are and its SourceFileLineNum
+			// is the line it starts on:
+			ruleLineNum := lineNum
+			ruleRaw := line
+			for strings.HasSuffix(aline, backslash) {
+				if !scanner.Scan() {
+					break
+				}
+				lineNum++
+				next := scanner.Text()
+				ruleRaw += "\n" + next
+				aline = strings.TrimSuffix(aline, backslash) + strings.TrimSpace(next)
+			}
+			if ruleLineNum != lineNum {
+				multipleLineRules++
+			}
+			// at a minimum, a Rule must consist of an "action", "sid", and "msg";
+			// rules without a "gid:?;" default to gid=1 see:
+			// http://manual.snort.org/node31.html#SECTION00443000000000000000
+			parsed, ok := ParseRule(aline)
+			if !ok || parsed.Sid == "" || parsed.Msg == "" {
+				continue
+			}
+			gid_sid := parsed.Gid + ":" + parsed.Sid
+			aRule := Rule{sourceFileIndex, ruleLineNum, parsed.Gid, parsed.Sid, parsed.Msg, ruleRaw, &parsed}
+
+			// every revision is kept, the first rule found with each revision wins:
+			gid_sid_rev := gid_sid + ":" + fmt.Sprint(parsed.Rev)
+			_, isDuplicateRevision := rs.Revisions[gid_sid_rev]
+			if parsed.Rev != 0 && !isDuplicateRevision {
+				rs.Revisions[gid_sid_rev] = aRule
+			}
+			if history {
+				continue
+			}
+
+			// this line is a rule, so add it to Rules unless it's a duplicate
+			inUseRule, isDuplicateRule := rs.Rules[gid_sid]
+			if isDuplicateRule {
+				if inUseRule.Parsed != nil && inUseRule.Parsed.Rev != parsed.Rev {
+					logp.Debug("rules", "loadRuleFile: rule %v revision %v on line# %v from file: %v kept as a revision of the rule on line# %v from file: %v",
+						gid_sid, parsed.Rev, ruleLineNum, aFile.Name(), inUseRule.SourceFileLineNum, rs.SourceFiles[inUseRule.SourceFileIndex])
+					continue
+				}
+				// first rule found wins, who knows how Snort handles this issue
+				logp.Info("\nWARNING ignoring \"duplicate\" Rule on line# %v from file:\n\t%v\n", ruleLineNum, aFile.Name())
+				logp.Info("\tduplicate of Rule on line# %v from file:\n", inUseRule.SourceFileLineNum)
+				logp.Info("\t%v\n", rs.SourceFiles[inUseRule.SourceFileIndex])
+				logp.Info("\tgid_sid=%v\n", gid_sid)
+				// debug duplicate rules:
+				// shellcode.rules often has duplicate rules based on gid+sid but with different protocols (tcp vs udp)
+				duplicateRuleWarnings++
+				continue
+			} else {
+				rs.Rules[gid_sid] = aRule
+			}
+		}
+	}
+	return multipleLineRules, duplicateRuleWarnings, nil
+}
 
-	// create a list of files based on rulePaths array (unifiedbeat.rules.paths in unifiedbeat.yml):
+// globRuleFiles lists the rule files of the rulePaths array
+// (unifiedbeat.rules.paths in unifiedbeat.yml), which are files,
+// folders of files or globs of either.
+func globRuleFiles(rulePaths []string) ([]string, error) {
 	var ruleFileNames []string
 	for _, apath := range rulePaths {
 		// evaluate apath as a wildcards/shell glob
 		matches, err := filepath.Glob(apath)
 		if err != nil {
 			logp.Debug("rules", "filepath.Glob(%s) failed: %v", apath, err)
-			return 0, 0, err
+			return nil, err
 		}
 		for _, amatch := range matches {
 			logp.Debug("rules", "processing matched file: %s", amatch)
@@ -105,11 +310,11 @@ func LoadRules(genMsgMapPath string, rulePaths []string) (int, int, error) {
 			if fileinfo.IsDir() {
 				dir, err := os.Open(amatch) // open folder to get list of rules files
 				if err != nil {
-					return 0, 0, err
+					return nil, err
 				}
 				fileNames, err := dir.Readdirnames(-1)
 				if err != nil {
-					return 0, 0, err
+					return nil, err
 				}
 				dir.Close()
 				for _, aFileName := range fileNames {
@@ -120,88 +325,18 @@ func LoadRules(genMsgMapPath string, rulePaths []string) (int, int, error) {
 			}
 		}
 	}
-
-	// process each rule file:
-	sourceFileIndex := 0
-	for _, filename := range ruleFileNames {
-		aFile, err := os.Open(filename)
-		if err != nil {
-			return 0, 0, err
-		}
-		// avoid duplicating path and filename's for each rule (less memory)
-		SourceFiles = append(SourceFiles, aFile.Name())
-		sourceFileIndex = len(SourceFiles) - 1
-
-		scanner := bufio.NewScanner(aFile)
-		lineNum := 0
-		for scanner.Scan() {
-			aline := strings.TrimSpace(scanner.Text())
-			lineNum++
-			if len(aline) <= 0 {
-				continue
-			}
-			// at a minimum, a Rule must consist of an "action", "sid", and "msg"
-			matchedRuleAction := matchRuleActions.MatchString(aline)
-			if matchedRuleAction {
-				// no regexp's seem to match a backlash "\" at the end of a line,
-				// so just check the last character instead:
-				eol := len(aline) - 1
-				lastChar := string(aline[eol])
-				if lastChar == backslash {
-					// maybe, some day, deal with multi-line rules, maybe
-					logp.Info("WARNING ignoring \"multiple line\" Rule on line# %v from file:\n\t%v\n", lineNum, aFile.Name())
-					multipleLineWarnings++
-					continue
-				}
-				// check for "gid:?;", but usually rules default to gid=1 see:
-				// http://manual.snort.org/node31.html#SECTION00443000000000000000
-				matchedRuleGid := matchRuleGid.FindStringSubmatch(aline)
-				if len(matchedRuleGid) < 2 {
-					matchedRuleGid = append(matchedRuleGid, "")
-					matchedRuleGid = append(matchedRuleGid, defaultGid)
-				}
-				matchedRuleSid := matchRuleSid.FindStringSubmatch(aline)
-				if len(matchedRuleSid) < 2 {
-					continue
-				}
-				gid_sid := matchedRuleGid[1] + ":" + matchedRuleSid[1]
-
-				matchedRuleMsg := matchRuleMsg.FindStringSubmatch(aline)
-				if len(matchedRuleMsg) < 2 {
-					continue
-				}
-
-				// this line is a rule, so add it to Rules unless it's a duplicate
-				inUseRule, isDuplicateRule := Rules[gid_sid]
-				if isDuplicateRule {
-					// first rule found wins, who knows how Snort handles this issue
-					logp.Info("\nWARNING ignoring \"duplicate\" Rule on line# %v from file:\n\t%v\n", lineNum, aFile.Name())
-					logp.Info("\tduplicate of Rule on line# %v from file:\n", inUseRule.SourceFileLineNum)
-					logp.Info("\t%v\n", SourceFiles[inUseRule.SourceFileIndex])
-					logp.Info("\tgid_sid=%v\n", gid_sid)
-					// debug duplicate rules:
-					// shellcode.rules often has duplicate rules based on gid+sid but with different protocols (tcp vs udp)
-					duplicateRuleWarnings++
-					continue
-				} else {
-					Rules[gid_sid] = Rule{sourceFileIndex, lineNum, matchedRuleGid[1], matchedRuleSid[1], matchedRuleMsg[1], aline}
-				}
-			}
-		}
-		aFile.Close()
-	}
-	return multipleLineWarnings, duplicateRuleWarnings, err
+	return ruleFileNames, nil
 }
 
-func loadGenMsgMap(genMsgMapPath string) (int, error) {
+func (rs *RuleSet) loadGenMsgMap(genMsgMapPath string) (int, error) {
 	var duplicateRuleWarnings int
 	f, err := os.Open(genMsgMapPath)
 	if err != nil {
 		return 0, err
 	}
 	defer f.Close()
-	SourceFiles = append(SourceFiles, genMsgMapPath)
-	sourceFileIndex := len(SourceFiles) - 1
+	rs.SourceFiles = append(rs.SourceFiles, genMsgMapPath)
+	sourceFileIndex := len(rs.SourceFiles) - 1
 
 	scanner := bufio.NewScanner(f)
 	lineNum := 0
@@ -214,16 +349,16 @@ func loadGenMsgMap(genMsgMapPath string) (int, error) {
 			sid := strings.TrimSpace(words[1])
 			msg := strings.TrimSpace(words[2])
 			gid_sid := gid + ":" + sid
-			inUseRule, isDuplicateRule := Rules[gid_sid]
+			inUseRule, isDuplicateRule := rs.Rules[gid_sid]
 			if isDuplicateRule {
 				// first rule found wins, who knows how Snort handles this issue
 				logp.Info("WARNING ignoring \"duplicate\" Rule on line# %v from file:\n\t%v\n", lineNum, genMsgMapPath)
 				logp.Info("\tduplicate of Rule on line# %v from file:\n", inUseRule.SourceFileLineNum)
-				logp.Info("\t%v\n", SourceFiles[inUseRule.SourceFileIndex])
+				logp.Info("\t%v\n", rs.SourceFiles[inUseRule.SourceFileIndex])
 				duplicateRuleWarnings++
 				continue
 			} else {
-				Rules[gid_sid] = Rule{sourceFileIndex, lineNum, gid, sid, msg, aline}
+				rs.Rules[gid_sid] = Rule{sourceFileIndex, lineNum, gid, sid, msg, aline, nil}
 			}
 		}
 	}
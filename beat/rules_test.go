@@ -0,0 +1,96 @@
+/* Copyright (c) 2016 Chris Smith
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED ``AS IS'' AND ANY EXPRESS OR IMPLIED
+ * WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package unifiedbeat
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// A rule's RuleRaw keeps its lines exactly as they are in the file,
+// while the rule is parsed from the lines joined.
+func TestLoadRuleFileMultipleLines(t *testing.T) {
+	lines := []string{
+		`# a comment`,
+		``,
+		`  alert tcp any any -> any 80 (msg:"one line"; sid:1; rev:1;)  `,
+		`	alert tcp any any -> any 80 \`,
+		`    (msg:"three lines"; \`,
+		`    sid:2; rev:3;)   `,
+		`alert udp any any -> any 53 (msg:"two lines"; \`,
+		`sid:3; rev:1;)`,
+	}
+	tests := []struct {
+		gidSid  string
+		lineNum int
+		msg     string
+		raw     string
+	}{
+		{"1:1", 3, "one line", lines[2]},
+		{"1:2", 4, "three lines", strings.Join(lines[3:6], "\n")},
+		{"1:3", 7, "two lines", strings.Join(lines[6:8], "\n")},
+	}
+
+	folder, err := ioutil.TempDir("", "unifiedbeat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+	filename := filepath.Join(folder, "test.rules")
+	writeFile(t, filename, []byte(strings.Join(lines, "\n")+"\n"))
+
+	rs := NewRuleSet()
+	multipleLineRules, duplicates, err := rs.loadRuleFile(filename, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if multipleLineRules != 2 || duplicates != 0 {
+		t.Errorf("%v multiple line rules and %v duplicates, expected 2 and 0", multipleLineRules, duplicates)
+	}
+	if len(rs.Rules) != len(tests) {
+		t.Errorf("loaded %v rules, expected %v", len(rs.Rules), len(tests))
+	}
+	for _, test := range tests {
+		rule, found := rs.Rules[test.gidSid]
+		if !found {
+			t.Errorf("rule %v was not loaded", test.gidSid)
+			continue
+		}
+		if rule.SourceFileLineNum != test.lineNum {
+			t.Errorf("rule %v is on line %v, expected %v", test.gidSid, rule.SourceFileLineNum, test.lineNum)
+		}
+		if rule.Msg != test.msg {
+			t.Errorf("rule %v msg %q, expected %q", test.gidSid, rule.Msg, test.msg)
+		}
+		if rule.RuleRaw != test.raw {
+			t.Errorf("rule %v RuleRaw %q, expected %q", test.gidSid, rule.RuleRaw, test.raw)
+		}
+	}
+}
@@ -0,0 +1,287 @@
+/* Copyright (c) 2016 Chris Smith
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED ``AS IS'' AND ANY EXPRESS OR IMPLIED
+ * WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package unifiedbeat
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/cleesmith/go-unified2"
+
+	"github.com/elastic/beats/libbeat/logp"
+)
+
+// Sensor is one IDS sensor (e.g. one Snort instance per interface)
+// with its own spool folder, registry file, Rules and fields.
+type Sensor struct {
+	Name         string
+	Config       UnifiedbeatConfig
+	rules        *RuleLoader
+	registrar    *Registrar
+	acker        *Acker
+	pipeline     *Pipeline
+	done         <-chan struct{} // closed when the beat is stopping
+	archiver     Archiver
+	pollInterval time.Duration
+	quarantined  map[string]bool
+	// how often the registry file is written while spooling:
+	registryFlush time.Duration
+	lastFlush     time.Time
+	// publish events in batches of batchSize or after batchLatency:
+	batchSize    int
+	batchLatency time.Duration
+	// records are decoded into events by decodeWorkers goroutines:
+	decodeWorkers int
+}
+
+// NewSensor checks the settings for one sensor, loads its Rules (or
+// shares the RuleLoader in ruleLoaders of the same settings) and
+// its registry file. Like Setup it exits on invalid settings.
+func NewSensor(config UnifiedbeatConfig, ruleLoaders map[string]*RuleLoader) *Sensor {
+	s := &Sensor{
+		Name:        config.Name,
+		Config:      config,
+		quarantined: make(map[string]bool),
+	}
+
+	// It is possible for the Unified2Path to contain no files, as
+	// there may have been no sensor alerts/events yet, so we
+	// can not verify Unified2Prefix only that Unified2Path is valid.
+
+	u2PathPrefixSettings := path.Join(s.Config.Unified2Path, s.Config.Unified2Prefix)
+	// disallow filename globbing (remove all trailing *'s):
+	u2PathPrefixSettings = strings.TrimRight(u2PathPrefixSettings, "*")
+	// make path absolute (as it may be relative in unifiedbeat.yml):
+	absPath, err := filepath.Abs(u2PathPrefixSettings)
+	if err != nil {
+		// this is not really an error, but it should NOT happen:
+		logp.Info("Setup: %v failed to set the absolute path for unified2 files: '%s'", s, u2PathPrefixSettings)
+		absPath = u2PathPrefixSettings // whatever, just use it as-is
+	}
+	// ensure folder exists:
+	s.Config.Spooler.Folder = path.Dir(absPath)
+	_, err = os.Stat(s.Config.Spooler.Folder)
+	if err != nil {
+		// unable to find the unified2 files folder:
+		logp.Critical("Setup: ERROR: %v 'unified2_path' is an invalid path; correct the YAML config file!", s)
+		os.Exit(1)
+	}
+	s.Config.Spooler.FilePrefix = path.Base(absPath)
+
+	// what to do with each unified2 file after it is indexed:
+	s.archiver, err = NewArchiver(s.Config.Archive, s.Config.Spooler.Folder, s.Config.Spooler.FilePrefix)
+	if err != nil {
+		logp.Critical("Setup: ERROR: %v 'archive' settings: %v; correct the YAML config file!", s, err)
+		os.Exit(1)
+	}
+	if !*backfill {
+		// backfill reads files, often from the archive, and leaves them be:
+		s.archiver.Prune()
+	}
+
+	if s.Config.Recovery.QuarantineFolder != "" {
+		info, err := os.Stat(s.Config.Recovery.QuarantineFolder)
+		if err != nil || !info.IsDir() {
+			logp.Critical("Setup: ERROR: %v 'quarantine_folder' is an invalid path; correct the YAML config file!", s)
+			os.Exit(1)
+		}
+	}
+
+	if len(s.Config.Rules.GenMsgMapPath) == 0 {
+		logp.Critical("Setup: ERROR: %v required path to 'gen_msg_map_path' not specified in YAML config file!", s)
+		os.Exit(1)
+	}
+	if len(s.Config.Rules.Paths) == 0 {
+		logp.Critical("Setup: ERROR: %v required path(s) to Rule files not specified in YAML config file!", s)
+		os.Exit(1)
+	}
+
+	// load Rules and SourceFiles, once for each distinct rules setting:
+	rulesKey := s.Config.Rules.GenMsgMapPath + "|" + s.Config.Rules.ClassificationPath + "|" + s.Config.Rules.ReferencePath + "|" + strings.Join(s.Config.Rules.Paths, "|") + "|" + strings.Join(s.Config.Rules.HistoryPaths, "|")
+	s.rules = ruleLoaders[rulesKey]
+	if s.rules == nil {
+		s.rules, err = NewRuleLoader(s.Config.Rules, s)
+		if err != nil {
+			logp.Critical("Setup: %v loading Rules error: %v", s, err)
+			os.Exit(1)
+		}
+		ruleLoaders[rulesKey] = s.rules
+	} else {
+		logp.Info("Setup: %v sharing Rules with another sensor", s)
+		s.rules.sensors = append(s.rules.sensors, s.Name)
+	}
+
+	s.pollInterval = time.Duration(500) * time.Millisecond // default is 500 milliseconds
+	if s.Config.SpoolPollMs > 0 {
+		s.pollInterval = time.Duration(s.Config.SpoolPollMs) * time.Millisecond
+	}
+	switch s.Config.SpoolWatch {
+	case "", "auto", "inotify", "poll":
+	default:
+		logp.Critical("Setup: ERROR: %v 'spool_watch' must be one of: auto, inotify, poll; correct the YAML config file!", s)
+		os.Exit(1)
+	}
+
+	switch s.Config.DocumentId {
+	case "", "event", "offset":
+	default:
+		logp.Critical("Setup: ERROR: %v 'document_id' must be one of: event, offset; correct the YAML config file!", s)
+		os.Exit(1)
+	}
+
+	// by default registry files are created in the current working directory:
+	registryFile := s.Config.RegistryFile
+	if registryFile == "" {
+		registryFile = ".unifiedbeat"
+		if s.Name != "" {
+			registryFile += "_" + s.Name
+		}
+	}
+	s.registrar, err = NewRegistrar(registryFile)
+	if err != nil {
+		logp.Critical("Setup: %v unable to set registry file error: %v", s, err)
+		os.Exit(1)
+	}
+	s.registrar.LoadState()
+	s.registrar.Prune(s.Config.Spooler.Folder)
+	s.acker = NewAcker(s)
+	s.registryFlush = time.Duration(10) * time.Second // default is 10 seconds
+	if s.Config.RegistryFlush > 0 {
+		s.registryFlush = time.Duration(s.Config.RegistryFlush) * time.Second
+	}
+	s.lastFlush = time.Now()
+
+	s.batchSize = 200 // default is 200 events
+	if s.Config.BatchSize > 0 {
+		s.batchSize = s.Config.BatchSize
+	}
+	s.batchLatency = time.Duration(1000) * time.Millisecond // default is 1 second
+	if s.Config.BatchFlushMs > 0 {
+		s.batchLatency = time.Duration(s.Config.BatchFlushMs) * time.Millisecond
+	}
+	s.decodeWorkers = runtime.NumCPU() // default is one per CPU
+	if s.Config.DecodeWorkers > 0 {
+		s.decodeWorkers = s.Config.DecodeWorkers
+	}
+	logp.Info("Setup: %v registrar: registry file: %#v", s, s.registrar.registryFile)
+	logp.Info("Setup: %v registrar: file source: %#v", s, s.registrar.State.Source)
+	logp.Info("Setup: %v registrar: file offset: %#v", s, s.registrar.State.Offset)
+
+	return s
+}
+
+// closeFile is the reader's CloseHook: once its last events are
+// published and the output has acknowledged all of them the fully
+// indexed file is marked as finished, archived and the registry
+// file is written. When told to stop before then, e.g. while the
+// output is down, the file is left as it is and read again on restart.
+func (s *Sensor) closeFile(filename string) {
+	if !s.pipeline.Sync() || !s.acker.WaitOrStop(s.done) {
+		logp.Info("closeFile: %v stopping before the events of '%v' were acknowledged; it is not archived and is read again on restart", s, filename)
+		return
+	}
+	s.registrar.Finished(filename)
+	s.archiver.Archive(filename)
+	if _, err := os.Stat(filename); err != nil {
+		// renamed, moved or deleted by the archiver:
+		s.registrar.Forget(filename)
+	}
+	s.writeRegistry()
+}
+
+// skipSince records the files -since skipped as finished, and where it
+// starts, so a restart without -since does not read them again. The
+// skipped files are archived once read past on that restart.
+func (s *Sensor) skipSince(reader *unified2.SpoolRecordReader) {
+	for _, filename := range reader.Skipped() {
+		logp.Info("skipSince: %v skipping '%v'", s, filename)
+		s.registrar.Finished(filename)
+	}
+	if reader.FileSource != "" {
+		s.registrar.Update(reader.FileSource, reader.FileOffset)
+	}
+	s.writeRegistry()
+}
+
+// drain publishes the records in the pipeline then waits, for at most "timeout"
+// in all, for the output to acknowledge it and the events already published
+// so the registry is up-to-date.
+func (s *Sensor) drain(timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	if !s.pipeline.Close(timeout) || !s.acker.WaitTimeout(deadline.Sub(time.Now())) {
+		logp.Warn("%v stopping with events not yet acknowledged after %v; they are sent again on restart", s, timeout)
+	}
+}
+
+// flushRegistry writes the registry file once registryFlush has
+// passed since it was last written.
+func (s *Sensor) flushRegistry() {
+	if time.Since(s.lastFlush) >= s.registryFlush {
+		s.writeRegistry()
+	}
+}
+
+func (s *Sensor) writeRegistry() {
+	if err := s.registrar.WriteRegistry(); err != nil {
+		logp.Warn("%v unable to write registry file: '%v'", s, err)
+	}
+	s.lastFlush = time.Now()
+}
+
+// RuleSet is the sensor's current RuleSet, see RuleLoader.
+func (s *Sensor) RuleSet() *RuleSet {
+	return s.rules.RuleSet()
+}
+
+// String is used to tell sensors apart in log messages.
+func (s *Sensor) String() string {
+	if s.Name == "" {
+		return "sensor"
+	}
+	return "sensor '" + s.Name + "'"
+}
+
+// NewFileEvent wraps a unified2 record, read from the file "source"
+// ending at "offset", with this sensor's Rules and fields.
+func (s *Sensor) NewFileEvent(source string, offset int64, record interface{}) *FileEvent {
+	event := &FileEvent{
+		ReadTime:     time.Now(),
+		Source:       source,
+		InputType:    "unified2",
+		DocumentType: "unified2", // this changes for each unified2 record type
+		Offset:       offset,
+		U2Record:     record,
+		RuleSet:      s.RuleSet(),
+		Fields:       &s.Config.Fields,
+	}
+	event.SetFieldsUnderRoot(s.Config.FieldsUnderRoot)
+	return event
+}
@@ -0,0 +1,177 @@
+/* Copyright (c) 2016 Chris Smith
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED ``AS IS'' AND ANY EXPRESS OR IMPLIED
+ * WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package unifiedbeat
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/elastic/beats/libbeat/logp"
+)
+
+// SpoolWatcher wakes up the spool loop when the unified2 file being
+// tailed grows, or when a file with the spool prefix appears, is
+// renamed or is removed.  This replaces sleeping and re-reading the
+// spool folder over and over while waiting for the sensor.
+type SpoolWatcher interface {
+	// Changes receives a value whenever something happened to a
+	// unified2 file in the spool folder.  Several changes may be
+	// collapsed into one value.
+	Changes() <-chan struct{}
+
+	// DirChanged reports whether files were added, removed or renamed
+	// since the last call, and resets that state.
+	DirChanged() bool
+
+	Close() error
+}
+
+// NewSpoolWatcher returns an inotify based watcher when possible,
+// otherwise a watcher that polls the spool folder. The "mode" is
+// "auto" (or empty), "inotify" or "poll".
+func NewSpoolWatcher(folder, prefix, mode string, pollInterval time.Duration) (SpoolWatcher, error) {
+	switch mode {
+	case "", "auto":
+		w, err := newInotifyWatcher(folder, prefix)
+		if err == nil {
+			logp.Info("NewSpoolWatcher: using inotify for spool folder: '%v'", folder)
+			return w, nil
+		}
+		logp.Info("NewSpoolWatcher: inotify unavailable (%v); polling spool folder every %v", err, pollInterval)
+		return newPollWatcher(folder, prefix, pollInterval), nil
+	case "inotify":
+		w, err := newInotifyWatcher(folder, prefix)
+		if err != nil {
+			return nil, err
+		}
+		logp.Info("NewSpoolWatcher: using inotify for spool folder: '%v'", folder)
+		return w, nil
+	case "poll":
+		logp.Info("NewSpoolWatcher: polling spool folder every %v", pollInterval)
+		return newPollWatcher(folder, prefix, pollInterval), nil
+	}
+	return nil, fmt.Errorf("unknown spool_watch mode: '%v'", mode)
+}
+
+// spoolSignal holds the state shared by both kinds of watchers.
+type spoolSignal struct {
+	changes    chan struct{}
+	dirChanged int32
+}
+
+func newSpoolSignal() spoolSignal {
+	return spoolSignal{changes: make(chan struct{}, 1)}
+}
+
+func (s *spoolSignal) Changes() <-chan struct{} {
+	return s.changes
+}
+
+func (s *spoolSignal) DirChanged() bool {
+	return atomic.SwapInt32(&s.dirChanged, 0) == 1
+}
+
+// notify never blocks, as a pending wake up covers this change too.
+func (s *spoolSignal) notify(dirChanged bool) {
+	if dirChanged {
+		atomic.StoreInt32(&s.dirChanged, 1)
+	}
+	select {
+	case s.changes <- struct{}{}:
+	default:
+	}
+}
+
+// pollWatcher is the fallback when inotify is not available, it
+// compares the names and sizes of the spool files on each tick.
+type pollWatcher struct {
+	spoolSignal
+	folder   string
+	prefix   string
+	interval time.Duration
+	names    string
+	sizes    int64
+	quit     chan struct{}
+}
+
+func newPollWatcher(folder, prefix string, interval time.Duration) *pollWatcher {
+	w := &pollWatcher{
+		spoolSignal: newSpoolSignal(),
+		folder:      folder,
+		prefix:      prefix,
+		interval:    interval,
+		quit:        make(chan struct{}),
+	}
+	w.names, w.sizes = w.scan()
+	go w.run()
+	return w
+}
+
+func (w *pollWatcher) run() {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.quit:
+			return
+		case <-ticker.C:
+			names, sizes := w.scan()
+			if names != w.names {
+				w.notify(true)
+			} else if sizes != w.sizes {
+				w.notify(false)
+			}
+			w.names, w.sizes = names, sizes
+		}
+	}
+}
+
+// scan returns the spool file names and the sum of their sizes.
+func (w *pollWatcher) scan() (string, int64) {
+	files, err := ioutil.ReadDir(w.folder)
+	if err != nil {
+		logp.Info("pollWatcher: failed to read spool folder '%v'; error: %v", w.folder, err)
+		return w.names, w.sizes
+	}
+	var names []string
+	var sizes int64
+	for _, file := range files {
+		if strings.HasPrefix(file.Name(), w.prefix) {
+			names = append(names, file.Name())
+			sizes += file.Size()
+		}
+	}
+	return strings.Join(names, "/"), sizes
+}
+
+func (w *pollWatcher) Close() error {
+	close(w.quit)
+	return nil
+}
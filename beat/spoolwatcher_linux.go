@@ -0,0 +1,199 @@
+/* Copyright (c) 2016 Chris Smith
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED ``AS IS'' AND ANY EXPRESS OR IMPLIED
+ * WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package unifiedbeat
+
+import (
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/elastic/beats/libbeat/logp"
+)
+
+const (
+	inotifyDirMask  = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+	inotifyFileMask = syscall.IN_MODIFY | syscall.IN_CLOSE_WRITE
+)
+
+// inotifyWatcher watches the spool folder itself, which covers both
+// the file being tailed and any new files written by the sensor.
+//
+// The inotify fd is blocking, as go1.6 does not poll an os.File made
+// from a non-blocking fd, its Read just fails with EAGAIN; run waits in
+// epoll for either inotify or the pipe Close writes to, so Close can
+// interrupt it.
+type inotifyWatcher struct {
+	spoolSignal
+	fd     int
+	epfd   int
+	pipe   [2]int
+	prefix string
+	done   chan struct{} // closed once run has returned
+	once   sync.Once
+}
+
+func newInotifyWatcher(folder, prefix string) (*inotifyWatcher, error) {
+	w := &inotifyWatcher{
+		spoolSignal: newSpoolSignal(),
+		fd:          -1,
+		epfd:        -1,
+		pipe:        [2]int{-1, -1},
+		prefix:      prefix,
+		done:        make(chan struct{}),
+	}
+	err := w.open(folder)
+	if err != nil {
+		w.closeFds()
+		return nil, err
+	}
+	go w.run()
+	return w, nil
+}
+
+func (w *inotifyWatcher) open(folder string) error {
+	var err error
+	w.fd, err = syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	_, err = syscall.InotifyAddWatch(w.fd, folder, inotifyDirMask|inotifyFileMask)
+	if err != nil {
+		return err
+	}
+	err = syscall.Pipe2(w.pipe[:], syscall.O_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	w.epfd, err = syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	for _, fd := range []int{w.fd, w.pipe[0]} {
+		event := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(fd)}
+		err = syscall.EpollCtl(w.epfd, syscall.EPOLL_CTL_ADD, fd, &event)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *inotifyWatcher) closeFds() {
+	for _, fd := range []int{w.epfd, w.fd, w.pipe[0], w.pipe[1]} {
+		if fd >= 0 {
+			syscall.Close(fd)
+		}
+	}
+}
+
+// wait blocks until there are inotify events to read, and reports
+// false once Close was called.
+func (w *inotifyWatcher) wait() (bool, error) {
+	events := make([]syscall.EpollEvent, 2)
+	for {
+		n, err := syscall.EpollWait(w.epfd, events, -1)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		for _, event := range events[:n] {
+			if int(event.Fd) == w.pipe[0] {
+				return false, nil
+			}
+		}
+		if n > 0 {
+			return true, nil
+		}
+	}
+}
+
+func (w *inotifyWatcher) run() {
+	defer close(w.done)
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		ready, err := w.wait()
+		if !ready {
+			if err != nil {
+				// wake the spool loop so it carries on with its
+				// own periodic checks:
+				logp.Info("inotifyWatcher: wait stopped: %v", err)
+				w.notify(true)
+			}
+			return
+		}
+		n, err := syscall.Read(w.fd, buf)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			logp.Info("inotifyWatcher: read stopped: %v", err)
+			w.notify(true)
+			return
+		}
+		offset := 0
+		for offset+syscall.SizeofInotifyEvent <= n {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			nameEnd := nameStart + int(event.Len)
+			if nameEnd > n {
+				break
+			}
+			name := strings.TrimRight(string(buf[nameStart:nameEnd]), "\x00")
+			offset = nameEnd
+
+			switch {
+			case event.Mask&syscall.IN_Q_OVERFLOW != 0:
+				// events were lost, so assume everything changed:
+				w.notify(true)
+			case event.Mask&syscall.IN_IGNORED != 0:
+				logp.Info("inotifyWatcher: spool folder is no longer watched")
+				w.notify(true)
+			case !strings.HasPrefix(name, w.prefix):
+				// some other file in the spool folder
+			case event.Mask&inotifyDirMask != 0:
+				w.notify(true)
+			case event.Mask&inotifyFileMask != 0:
+				w.notify(false)
+			}
+		}
+	}
+}
+
+// Close wakes run through the pipe, waits for it to return, and only
+// then closes the fds, so none is closed while still in use.
+func (w *inotifyWatcher) Close() error {
+	var err error
+	w.once.Do(func() {
+		_, err = syscall.Write(w.pipe[1], []byte{0})
+		<-w.done
+		w.closeFds()
+	})
+	return err
+}
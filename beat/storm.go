@@ -0,0 +1,298 @@
+/* Copyright (c) 2016 Chris Smith
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED ``AS IS'' AND ANY EXPRESS OR IMPLIED
+ * WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package unifiedbeat
+
+import (
+	"expvar"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/elastic/beats/libbeat/common"
+)
+
+// Counts of events suppressed during alert storms, see the expvar web
+// interface (-httpprof).
+var stormCounts = expvar.NewMap("unifiedbeatStorms")
+
+type StormConfig struct {
+	Enabled bool
+	// fields that, with the gid:sid, tell one storm from another
+	Key []string
+	// events per window that are published in full
+	Threshold int
+	// seconds, of event time, a window lasts
+	Window int
+}
+
+// the fields a summary copies from the events it counts
+var stormSummaryFields = []string{"sensor_id", "generator_id", "signature_id", "signature_revision",
+	"signature", "classification_id", "priority", "protocol", "source", "input_type", "fields"}
+
+// stormWindow counts the events of one storm key.
+type stormWindow struct {
+	key        string
+	sample     common.MapStr // the first event suppressed
+	count      int
+	start      time.Time // event time the window started
+	lastSeen   time.Time
+	deadline   time.Time // wall clock time the window ends at the latest
+	checkpoint int64     // where the first event suppressed starts
+}
+
+// Storm sits in front of a sensor's Batch.  It counts the events of
+// each gid:sid plus the "key" fields in windows of "window" seconds of
+// event time.  The first "threshold" events of a window are passed on,
+// the rest are suppressed, along with their packets and extradata, and
+// once the window is over a single "summary" document is published
+// with their count, first_seen, last_seen and a sample event_id.
+// A window is over when an event of any key is "window" seconds past
+// its start, or "window" seconds of wall clock time after it started
+// when no events come.
+//
+// The registry must not move past a suppressed event before its
+// summary is published, so documents passed on meanwhile carry the
+// start of the first event suppressed in any window as their offset,
+// and windows with suppressed events end when their file is closed.
+type Storm struct {
+	out       eventAdder
+	key       []string
+	threshold int
+	window    time.Duration
+	shared    []string
+	windows   map[string]*stormWindow
+	// the events suppressed, whose packets and extradata are too:
+	suppressed map[alertKey]bool
+	now        time.Time // latest event time seen
+	source     string
+	offset     int64 // end of the last document added
+	held       int   // windows with suppressed events
+	oldest     int64 // the earliest checkpoint of those windows
+}
+
+func NewStorm(out eventAdder, config StormConfig, fields map[string]string, fieldsUnderRoot bool) *Storm {
+	s := &Storm{
+		out:        out,
+		key:        config.Key,
+		threshold:  config.Threshold,
+		window:     time.Duration(config.Window) * time.Second,
+		shared:     append(append([]string{}, stormSummaryFields...), config.Key...),
+		windows:    make(map[string]*stormWindow),
+		suppressed: make(map[alertKey]bool),
+	}
+	if s.threshold <= 0 {
+		s.threshold = 100
+	}
+	if s.window <= 0 {
+		s.window = time.Minute
+	}
+	if fieldsUnderRoot {
+		for key := range fields {
+			s.shared = append(s.shared, key)
+		}
+	}
+	return s
+}
+
+// Add passes a document on, unless it belongs to a suppressed event.
+func (s *Storm) Add(event common.MapStr, source string, offset int64) {
+	// a document starts where the one before it ended, the start of the
+	// first document read from a file is not known, but 0 is safe:
+	start := s.offset
+	if source != s.source {
+		start = 0
+	}
+	s.source = source
+	s.offset = offset
+	key, isEvent := stormEventKey(event)
+	switch event["type"] {
+	case "event", "alert":
+	case "packet", "extradata":
+		if isEvent && s.suppressed[key] {
+			stormCounts.Add(event["type"].(string), 1)
+			return
+		}
+		s.out.Add(event, source, s.checkpoint(offset))
+		return
+	default:
+		s.out.Add(event, source, s.checkpoint(offset))
+		return
+	}
+
+	seen := time.Now()
+	if t, ok := event["@timestamp"].(common.Time); ok {
+		seen = time.Time(t)
+	}
+	if seen.After(s.now) {
+		s.now = seen
+		s.summarize(false)
+	}
+
+	windowKey := s.windowKey(event)
+	window, found := s.windows[windowKey]
+	if !found {
+		window = &stormWindow{key: windowKey, start: seen, deadline: time.Now().Add(s.window)}
+		s.windows[windowKey] = window
+	}
+	window.count++
+	if window.count <= s.threshold {
+		s.out.Add(event, source, s.checkpoint(offset))
+		return
+	}
+	if window.sample == nil {
+		window.sample = event
+		window.checkpoint = start
+		if s.held == 0 || start < s.oldest {
+			s.oldest = start
+		}
+		s.held++
+	}
+	window.lastSeen = seen
+	if len(s.suppressed) >= 4096 {
+		// an event's packets and extradata follow it closely
+		s.suppressed = make(map[alertKey]bool)
+	}
+	s.suppressed[key] = true
+	stormCounts.Add("event", 1)
+}
+
+// windowKey is "gid:sid" plus the values of the key fields.
+func (s *Storm) windowKey(event common.MapStr) string {
+	parts := []string{fmt.Sprintf("%v:%v", event["generator_id"], event["signature_id"])}
+	for _, field := range s.key {
+		parts = append(parts, fmt.Sprint(event[field]))
+	}
+	return strings.Join(parts, "|")
+}
+
+// stormEventKey is the event a document belongs to.
+func stormEventKey(event common.MapStr) (alertKey, bool) {
+	sensorId, ok1 := event["sensor_id"].(uint32)
+	eventId, ok2 := event["event_id"].(uint32)
+	eventSecond, ok3 := event["event_second"].(uint32)
+	return alertKey{sensorId, eventId, eventSecond}, ok1 && ok2 && ok3
+}
+
+// checkpoint is how far the registry may move once a document that
+// ends at "offset" is acknowledged: no further than the start of the
+// first event suppressed whose summary is not yet published.
+func (s *Storm) checkpoint(offset int64) int64 {
+	if s.held > 0 && s.oldest < offset {
+		return s.oldest
+	}
+	return offset
+}
+
+// summarize publishes the summaries of windows that are over, or of
+// all windows.
+func (s *Storm) summarize(all bool) {
+	wall := time.Now()
+	var over []*stormWindow
+	for key, window := range s.windows {
+		if !all && s.now.Sub(window.start) < s.window && wall.Before(window.deadline) {
+			continue
+		}
+		delete(s.windows, key)
+		if window.sample != nil {
+			over = append(over, window)
+		}
+	}
+	s.release(over)
+}
+
+// release publishes the summaries of windows that are over, once none
+// of them holds the registry back.
+func (s *Storm) release(over []*stormWindow) {
+	if len(over) == 0 {
+		return
+	}
+	s.held -= len(over)
+	s.oldest = s.offset
+	for _, window := range s.windows {
+		if window.sample != nil && window.checkpoint < s.oldest {
+			s.oldest = window.checkpoint
+		}
+	}
+	for _, window := range over {
+		s.publish(window)
+	}
+}
+
+func (s *Storm) publish(window *stormWindow) {
+	summary := common.MapStr{
+		"@timestamp":      common.Time(window.lastSeen),
+		"indexed_at":      common.Time(time.Now()),
+		"type":            "summary",
+		"record_type":     "summary",
+		"storm_key":       window.key,
+		"count":           window.count,
+		"suppressed":      window.count - s.threshold,
+		"first_seen":      common.Time(window.start),
+		"last_seen":       common.Time(window.lastSeen),
+		"sample_event_id": window.sample["event_id"],
+		"window_seconds":  int(s.window.Seconds()),
+	}
+	for _, field := range s.shared {
+		if value, ok := window.sample[field]; ok {
+			summary[field] = value
+		}
+	}
+	if meta, ok := window.sample["@metadata"].(common.MapStr); ok {
+		// see "beat/docid.go", one summary per window of a storm:
+		if id, ok := meta["_id"].(string); ok {
+			summary["@metadata"] = common.MapStr{"_id": id + "-summary"}
+		}
+	}
+	stormCounts.Add("summaries", 1)
+	s.out.Add(summary, s.source, s.checkpoint(s.offset))
+}
+
+// FlushIfDue publishes the summaries of windows that are over, it is
+// called whenever the pipeline is idle, so windows end on time even
+// when no more events come.
+func (s *Storm) FlushIfDue() {
+	s.summarize(false)
+}
+
+// Flush publishes the summaries of all windows, e.g. when stopping.
+func (s *Storm) Flush() {
+	s.summarize(true)
+}
+
+// FlushSuppressed ends the windows with suppressed events and publishes
+// their summaries, e.g. before their file is closed and archived.  Those
+// storms go on in new windows.
+func (s *Storm) FlushSuppressed() {
+	var over []*stormWindow
+	for key, window := range s.windows {
+		if window.sample != nil {
+			delete(s.windows, key)
+			over = append(over, window)
+		}
+	}
+	s.release(over)
+}
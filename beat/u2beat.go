@@ -27,30 +27,39 @@
 package unifiedbeat
 
 import (
+	"flag"
 	"fmt"
+	"net"
 	"os"
-	"path"
-	"path/filepath"
-	"strings"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
+	"github.com/cleesmith/go-unified2"
 	"github.com/elastic/beats/libbeat/beat"
 	"github.com/elastic/beats/libbeat/cfgfile"
+	"github.com/elastic/beats/libbeat/common"
 	"github.com/elastic/beats/libbeat/logp"
 	"github.com/elastic/beats/libbeat/publisher"
 )
 
-// The "quit" channel is used to tell
-// U2SpoolAndPublish to stop gracefully. This
-// ensures the registry file is up-to-date.
-// var quit chan bool
-
 type Unifiedbeat struct {
 	UbConfig     ConfigSettings
-	registrar    *Registrar
-	isSpooling   bool
+	sensors      []*Sensor
+	since        time.Time
 	spoolTimeout time.Duration
 	events       publisher.Client
+	// closing "done" tells U2SpoolAndPublish (or Backfill) to stop
+	// gracefully, Run closes "stopped" once it has, after writing
+	// the registry files, so Stop knows they are up-to-date:
+	done     chan struct{}
+	stopOnce sync.Once
+	stopped  chan struct{}
+	// serves the packets of events, see "pcap_listen":
+	pcapListener net.Listener
+	// one for each distinct rules setting of the sensors:
+	ruleLoaders []*RuleLoader
 }
 
 func New() *Unifiedbeat {
@@ -69,44 +78,41 @@ func (ub *Unifiedbeat) Config(b *beat.Beat) error {
 func (ub *Unifiedbeat) Setup(b *beat.Beat) error {
 	// Go overboard checking stuff . . .
 
-	// It is possible for the Unified2Path to contain no files, as
-	// there may have been no sensor alerts/events yet, so we
-	// can not verify Unified2Prefix only that Unified2Path is valid.
-
-	u2PathPrefixSettings := path.Join(ub.UbConfig.Sensor.Unified2Path, ub.UbConfig.Sensor.Unified2Prefix)
-	// disallow filename globbing (remove all trailing *'s):
-	u2PathPrefixSettings = strings.TrimRight(u2PathPrefixSettings, "*")
-	// make path absolute (as it may be relative in unifiedbeat.yml):
-	absPath, err := filepath.Abs(u2PathPrefixSettings)
-	if err != nil {
-		// this is not really an error, but it should NOT happen:
-		logp.Info("Setup: failed to set the absolute path for unified2 files: '%s'", u2PathPrefixSettings)
-		absPath = u2PathPrefixSettings // whatever, just use it as-is
+	// either a list of "sensors:" or the single "sensor:"
+	sensorConfigs := ub.UbConfig.Sensors
+	if len(sensorConfigs) == 0 {
+		sensorConfigs = []UnifiedbeatConfig{ub.UbConfig.Sensor}
 	}
-	// ensure folder exists:
-	ub.UbConfig.Sensor.Spooler.Folder = path.Dir(absPath)
-	_, err = os.Stat(ub.UbConfig.Sensor.Spooler.Folder)
-	if err != nil {
-		// unable to find the unified2 files folder:
-		logp.Critical("Setup: ERROR: 'unified2_path' is an invalid path; correct the YAML config file!")
-		os.Exit(1)
+	// each sensor's name is used for its registry file, so
+	// with more than one sensor the names must be unique:
+	if len(sensorConfigs) > 1 {
+		names := make(map[string]bool)
+		for _, sensorConfig := range sensorConfigs {
+			if sensorConfig.Name == "" || names[sensorConfig.Name] {
+				logp.Critical("Setup: ERROR: each of the 'sensors' requires a unique 'name'; correct the YAML config file!")
+				os.Exit(1)
+			}
+			names[sensorConfig.Name] = true
+		}
 	}
-	ub.UbConfig.Sensor.Spooler.FilePrefix = path.Base(absPath)
 
-	if len(ub.UbConfig.Sensor.Rules.GenMsgMapPath) == 0 {
-		logp.Critical("Setup: ERROR: required path to 'gen_msg_map_path' not specified in YAML config file!")
-		os.Exit(1)
-	}
-	if len(ub.UbConfig.Sensor.Rules.Paths) == 0 {
-		logp.Critical("Setup: ERROR: required path(s) to Rule files not specified in YAML config file!")
-		os.Exit(1)
+	// GeoIP2 is shared by all sensors:
+	geoip2Path := ""
+	for _, sensorConfig := range sensorConfigs {
+		if sensorConfig.Geoip2Path == "" {
+			continue
+		}
+		if geoip2Path != "" && geoip2Path != sensorConfig.Geoip2Path {
+			logp.Critical("Setup: ERROR: all sensors must use the same 'geoip2_path'; correct the YAML config file!")
+			os.Exit(1)
+		}
+		geoip2Path = sensorConfig.Geoip2Path
 	}
-
-	if ub.UbConfig.Sensor.Geoip2Path == "" {
+	if geoip2Path == "" {
 		logp.Info("Setup: 'geoip2_path:' not specified in YAML config file.")
 	} else {
 		// prefer to use GeoIP2 databases for geocoding both IPv4/6 addresses:
-		err := OpenGeoIp2DB(ub.UbConfig.Sensor.Geoip2Path)
+		err := OpenGeoIp2DB(geoip2Path)
 		if err != nil {
 			logp.Critical("Setup: failed opening 'GeoIp2' database; error: %v", err)
 			os.Exit(1)
@@ -114,107 +120,169 @@ func (ub *Unifiedbeat) Setup(b *beat.Beat) error {
 		logp.Info("Setup: activated 'GeoIP2' database for IP v4 and v6 geolocating.")
 	}
 
-	// load Rules and SourceFiles:
-	multipleLineWarnings, duplicateRuleWarnings, err := LoadRules(ub.UbConfig.Sensor.Rules.GenMsgMapPath, ub.UbConfig.Sensor.Rules.Paths)
-	if err != nil {
-		logp.Critical("Setup: loading Rules error: %v", err)
-		os.Exit(1)
+	// the longest spooler_timeout of all sensors limits how long
+	// shutdown waits for the output to acknowledge published events:
+	for _, sensorConfig := range sensorConfigs {
+		spoolTimeout := time.Duration(sensorConfig.SpoolerTimeout) * time.Second
+		if spoolTimeout > ub.spoolTimeout {
+			ub.spoolTimeout = spoolTimeout
+		}
+	}
+	if ub.spoolTimeout == 0 {
+		ub.spoolTimeout = time.Duration(5) * time.Second // default is 5 seconds
 	}
-	logp.Info("Setup: Rules warnings: %v multiple line rules rejected, %v duplicate rules rejected", multipleLineWarnings, duplicateRuleWarnings)
-	logp.Info("Setup: Rules stats: %v rule files read, %v rules created", len(SourceFiles), len(Rules))
 
-	ub.spoolTimeout = time.Duration(5) * time.Second // default is 5 seconds
-	if ub.UbConfig.Sensor.SpoolerTimeout > 0 {
-		ub.spoolTimeout = time.Duration(ub.UbConfig.Sensor.SpoolerTimeout) * time.Second
+	ruleLoaders := make(map[string]*RuleLoader)
+	for _, sensorConfig := range sensorConfigs {
+		ub.sensors = append(ub.sensors, NewSensor(sensorConfig, ruleLoaders))
 	}
+	for _, sensor := range ub.sensors {
+		if !ub.hasRuleLoader(sensor.rules) {
+			ub.ruleLoaders = append(ub.ruleLoaders, sensor.rules)
+		}
+	}
+	logp.Info("Setup: %v sensor(s) configured.", len(ub.sensors))
 
-	ub.events = b.Events
+	if *since != "" {
+		var err error
+		ub.since, err = unified2.ParseTime(*since)
+		if err != nil {
+			logp.Critical("Setup: ERROR: -since %v", err)
+			os.Exit(1)
+		}
+		logp.Info("Setup: all sensors start indexing at records since %v, not from their registry files.", ub.since)
+	}
 
-	// registry file is created in the current working directory:
-	ub.registrar, err = NewRegistrar(".unifiedbeat")
-	if err != nil {
-		logp.Critical("Setup: unable to set registry file error: %v", err)
-		os.Exit(1)
+	// see "beat/pcapserver.go":
+	if ub.UbConfig.PcapListen != "" && !*backfill {
+		var err error
+		ub.pcapListener, err = ServePcap(ub.UbConfig.PcapListen, ub.sensors)
+		if err != nil {
+			logp.Critical("Setup: ERROR: unable to listen on 'pcap_listen: %v' error: %v", ub.UbConfig.PcapListen, err)
+			os.Exit(1)
+		}
 	}
-	ub.registrar.LoadState()
-	logp.Info("Setup: registrar: registry file: %#v", ub.registrar.registryFile)
-	logp.Info("Setup: registrar: file source: %#v", ub.registrar.State.Source)
-	logp.Info("Setup: registrar: file offset: %#v", ub.registrar.State.Offset)
+
+	ub.events = b.Events
+	ub.done = make(chan struct{})
+	ub.stopped = make(chan struct{})
 
 	return nil
 }
 
 func (ub *Unifiedbeat) Run(b *beat.Beat) error {
+	defer close(ub.stopped)
+	defer ub.stop()
+
+	if *backfill {
+		// see "beat/backfill.go", the registry files are not used
+		return ub.Backfill(flag.Args())
+	}
+
 	logp.Info("Run: start spooling and publishing...")
 
-	// thoughts:
-	//
-	// 1. the "quit" channel is complicating things,
-	//    and it seems wrongheaded to use a channel
-	//    when there are no go routines, well actually
-	//    libbeat start this beat as a go routine
-	//    - so look at how other beats handle
-	//      global-like vars (IsRunning)
-	//
-	// 2. what about using a IsRunning bool in the
-	//    Unifiedbeat struct "ub.IsRunning", which
-	//    ub.U2SpoolAndPublish() can access/change
-	//    - only one U2SpoolAndPublish is ever running,
-	//      so there's no race/mutex issues
-
-	// use a channel to gracefully shutdown "U2SpoolAndPublish":
-	// quit = make(chan bool)
-
-	ub.isSpooling = true
-	ub.U2SpoolAndPublish()
-	// indicate that "U2SpoolAndPublish" returned unexpectedly,
-	// and that it is no longer running, so the "quit" code is ignored:
-	ub.isSpooling = false
-
-	// do a WriteRegistry as the "quit" channel code may fail,
-	// block, or whatever ... the worst is two writes of the
-	// same info to the registry file:
-	err := ub.registrar.WriteRegistry()
+	// see "beat/rulereload.go", rules are reloaded on SIGHUP
+	// and, if "watch" is set, when their files change:
+	for _, loader := range ub.ruleLoaders {
+		loader.Start(func(summary common.MapStr) {
+			ub.events.PublishEvent(summary)
+		})
+	}
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	defer signal.Stop(hangups)
+	go func() {
+		for {
+			select {
+			case <-ub.done:
+				return
+			case <-hangups:
+				logp.Info("Run: SIGHUP received; reloading rules.")
+				for _, loader := range ub.ruleLoaders {
+					loader.Reload()
+				}
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for _, sensor := range ub.sensors {
+		wg.Add(1)
+		go func(sensor *Sensor) {
+			defer wg.Done()
+			ub.U2SpoolAndPublish(sensor)
+			// when one sensor stops they all stop, just
+			// as the beat did with only a single sensor:
+			ub.stop()
+		}(sensor)
+	}
+	wg.Wait()
+	for _, loader := range ub.ruleLoaders {
+		loader.Close()
+	}
+
+	// every U2SpoolAndPublish has returned, so this
+	// is the one and only write of the registry files:
+	var err error
+	for _, sensor := range ub.sensors {
+		if werr := sensor.registrar.WriteRegistry(); werr != nil {
+			logp.Info("Run: %v failed to update registry file; error: %v", sensor, werr)
+			err = werr
+			continue
+		}
+		logp.Info("Run: %v updated registry file.", sensor)
+	}
 	if err != nil {
-		logp.Info("Run: failed to update registry file; error: %v", err)
 		return err // return to "main.go" after Stop() and Cleanup()
 	}
-	logp.Info("Run: updated registry file.")
 
 	// returning always calls Stop and Cleanup, and in that order
 	return nil // return to "main.go" after Stop() and Cleanup()
 }
 
+func (ub *Unifiedbeat) hasRuleLoader(loader *RuleLoader) bool {
+	for _, l := range ub.ruleLoaders {
+		if l == loader {
+			return true
+		}
+	}
+	return false
+}
+
+// stop tells U2SpoolAndPublish (or Backfill) to stop, it may be
+// called more than once.
+func (ub *Unifiedbeat) stop() {
+	ub.stopOnce.Do(func() { close(ub.done) })
+}
+
+// stopping reports whether stop has been called.
+func (ub *Unifiedbeat) stopping() bool {
+	select {
+	case <-ub.done:
+		return true
+	default:
+		return false
+	}
+}
+
 // Stop is called on exit before Cleanup
 // why isn't the flow Cleanup and then Stop?
+// It returns once Run has finished publishing and
+// has written the registry files.
 func (ub *Unifiedbeat) Stop() {
 	startStopping := time.Now()
-	logp.Info("Stop: is spooling and publishing running? '%v'", ub.isSpooling)
-	if ub.isSpooling {
-		ub.isSpooling = false
-		logp.Info("Stop: waiting %v for spool/publish to shutdown.", ub.spoolTimeout)
-
-		// lame, but might work
-		time.Sleep(ub.spoolTimeout)
-
-		// // tell "U2SpoolAndPublish" to shutdown:
-		// quit <- true
-		// // block/wait for "U2SpoolAndPublish" to close the quit channel:
-		// <-quit
-
-		err := ub.registrar.WriteRegistry()
-		if err != nil {
-			logp.Info("Stop: failed to update registry file; error: %v", err)
-		} else {
-			logp.Info("Stop: successfully updated registry file.")
-		}
-	}
+	logp.Info("Stop: is spooling and publishing running? '%v'", !ub.stopping())
+	ub.stop()
+	<-ub.stopped
 	elapsed := time.Since(startStopping)
 	logp.Info("Stop: done after waiting %v.", elapsed)
 }
 
 func (ub *Unifiedbeat) Cleanup(b *beat.Beat) error {
-	logp.Info("Cleanup: is spooling and publishing running? '%v'", ub.isSpooling)
+	if ub.pcapListener != nil {
+		ub.pcapListener.Close()
+		logp.Info("Cleanup: stopped serving event packets.")
+	}
 	// see "beat/geoip2.go":
 	if GeoIp2Reader != nil {
 		GeoIp2Reader.Close()
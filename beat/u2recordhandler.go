@@ -27,6 +27,7 @@
 package unifiedbeat
 
 import (
+	"encoding/base64"
 	"fmt"
 	"net"
 	"path/filepath"
@@ -52,6 +53,7 @@ type FileEvent struct {
 	DocumentType    string
 	Offset          int64
 	U2Record        interface{}
+	RuleSet         *RuleSet
 	Fields          *map[string]string
 	fieldsUnderRoot bool
 }
@@ -64,6 +66,16 @@ func (f *FileEvent) SetFieldsUnderRoot(fieldsUnderRoot bool) {
 }
 
 func (f *FileEvent) ToMapStr() common.MapStr {
+	// an OpenAppID event record is indexed as the event record it
+	// contains plus the name of the application:
+	if appEvent, ok := f.U2Record.(*unified2.AppIdEventRecord); ok {
+		eventRecord := *f
+		eventRecord.U2Record = &appEvent.EventRecord
+		event := eventRecord.ToMapStr()
+		event["app_name"] = appEvent.AppName
+		return event
+	}
+
 	event := common.MapStr{
 		"indexed_at":    common.Time(f.ReadTime),
 		"source":        f.Source,
@@ -91,21 +103,37 @@ func (f *FileEvent) ToMapStr() common.MapStr {
 		event["signature_revision"] = f.U2Record.(*unified2.EventRecord).SignatureRevision
 		event["classification_id"] = f.U2Record.(*unified2.EventRecord).ClassificationId
 		event["priority"] = f.U2Record.(*unified2.EventRecord).Priority
+		// the name of the classification, and whether the rule changed
+		// the priority from the classification's default:
+		if class, ok := f.RuleSet.Classification(f.U2Record.(*unified2.EventRecord).ClassificationId); ok {
+			event["classification"] = class.Name
+			event["classification_description"] = class.Description
+			event["classification_priority"] = class.Priority
+			event["priority_overridden"] = int(f.U2Record.(*unified2.EventRecord).Priority) != class.Priority
+		}
 
 		event["generator_id"] = f.U2Record.(*unified2.EventRecord).GeneratorId // GeneratorId uint32
 		event["signature_id"] = f.U2Record.(*unified2.EventRecord).SignatureId // SignatureId uint32
-		// SourceFiles, Rules, and Rule are available coz "rules.go" is part of this package
+		// the RuleSet is the one loaded for the sensor that wrote this record
 		gs := fmt.Sprint(event["generator_id"]) + ":" + fmt.Sprint(event["signature_id"])
-		aRule, ok := Rules[gs]
+		// the rule with the event's revision if there is one, then any revision:
+		aRule, ok, revisionFound := f.RuleSet.LookupRevision(f.U2Record.(*unified2.EventRecord).GeneratorId, f.U2Record.(*unified2.EventRecord).SignatureId, f.U2Record.(*unified2.EventRecord).SignatureRevision)
+		// the rules in gen-msg.map have no revisions:
+		if !ok || aRule.Parsed != nil {
+			event["rule_revision_mismatch"] = !revisionFound
+		}
 		if ok {
-			absPath, err := filepath.Abs(SourceFiles[aRule.SourceFileIndex])
+			absPath, err := filepath.Abs(f.RuleSet.SourceFiles[aRule.SourceFileIndex])
 			if err != nil {
-				absPath = SourceFiles[aRule.SourceFileIndex] // ok, just use it as-is
+				absPath = f.RuleSet.SourceFiles[aRule.SourceFileIndex] // ok, just use it as-is
 			}
 			event["rule_source_file"] = absPath
 			event["rule_source_file_line_number"] = aRule.SourceFileLineNum
 			event["signature"] = aRule.Msg
 			event["rule_raw"] = aRule.RuleRaw
+			if aRule.Parsed != nil {
+				aRule.Parsed.addFields(event, f.RuleSet)
+			}
 		} else {
 			logp.Info("ToMapStr: lookup gid+sid:%v failed to find rule\n", gs)
 		}
@@ -245,6 +273,43 @@ func (f *FileEvent) ToMapStr() common.MapStr {
 		event["extradata_data_type"] = f.U2Record.(*unified2.ExtraDataRecord).DataType
 		event["extradata_data_length"] = f.U2Record.(*unified2.ExtraDataRecord).DataLength
 		event["extradata_data"] = f.U2Record.(*unified2.ExtraDataRecord).Data
+
+	case *unified2.AppStatRecord:
+		event["type"] = "appstat" // set document type to match unified2 record type
+		event["record_type"] = "appstat"
+		// must assert ".(*unified2.AppStatRecord)." coz record is an interface{}
+		es = f.U2Record.(*unified2.AppStatRecord).StatTime
+		event["stat_second"] = es
+		ut = time.Unix(int64(es), 0)
+		event["@timestamp"] = common.Time(ut)
+
+		event["app_count"] = f.U2Record.(*unified2.AppStatRecord).AppCount
+		var apps []common.MapStr
+		var appNames []string
+		for _, app := range f.U2Record.(*unified2.AppStatRecord).Apps {
+			apps = append(apps, common.MapStr{
+				"app_name": app.AppName,
+				"tx_bytes": app.TxBytes,
+				"rx_bytes": app.RxBytes,
+			})
+			appNames = append(appNames, app.AppName)
+		}
+		event["apps"] = apps
+		event["app_name"] = appNames
+
+	case *UndecodedRecord:
+		// see "beat/raw.go"
+		raw := f.U2Record.(*UndecodedRecord)
+		event["type"] = "raw" // set document type to match unified2 record type
+		event["record_type"] = "raw"
+		event["raw_reason"] = raw.Reason
+		event["raw_record_type"] = raw.Type
+		event["raw_length"] = len(raw.Data)
+		// where the record starts, "source_offset" is where it ends:
+		event["raw_offset"] = f.Offset - unified2.RAW_HEADER_LEN - int64(len(raw.Data))
+		event["raw_data"] = base64.StdEncoding.EncodeToString(raw.Data)
+		// its data can not be trusted to hold a time:
+		event["@timestamp"] = common.Time(f.ReadTime)
 	}
 
 	// add any "optional additional fields" from unifiedbeat.yml:
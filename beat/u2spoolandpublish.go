@@ -27,11 +27,10 @@
 package unifiedbeat
 
 import (
-	"fmt"
+	"flag"
 	"io"
 	// "log"
-	"os"
-	"path"
+	// "os"
 	"time"
 
 	"github.com/cleesmith/go-unified2"
@@ -39,70 +38,121 @@ import (
 	"github.com/elastic/beats/libbeat/logp"
 )
 
+const (
+	spoolIdleWake       = time.Second
+	spoolRescanInterval = 30 * time.Second
+)
+
+// -since starts indexing every sensor from a point in time instead of
+// from its registry file, e.g. after an outage or a new deployment.
+var since *string
+
+func init() {
+	since = flag.String("since", "", "Start indexing from the first record at or after this time, e.g. 2016-02-01T00:00Z")
+}
+
 // "Spool" refers to handling a folder of unified2 files
 // in ascending order by filename as a continous
 // stream of records to be read and indexed.
 // Well, that's not whole story, as it is aware of each
 // file being indexed and will call the CloseHook func
 // when one is provided. CloseHook allows the program
-// to "archive/rename" the indexed file and timestamp it,
+// to "archive" the indexed file (see "beat/archive.go"),
 // which avoids continuously looping over the same data
 // leading to document duplication.
-func (ub *Unifiedbeat) U2SpoolAndPublish() {
-	logp.Info("U2SpoolAndPublish: spooling and publishing...")
-	reader := unified2.NewSpoolRecordReader(ub.UbConfig.Sensor.Spooler.Folder,
-		ub.UbConfig.Sensor.Spooler.FilePrefix)
+func (ub *Unifiedbeat) U2SpoolAndPublish(sensor *Sensor) {
+	logp.Info("U2SpoolAndPublish: %v spooling and publishing...", sensor)
+	reader := unified2.NewSpoolRecordReader(sensor.Config.Spooler.Folder,
+		sensor.Config.Spooler.FilePrefix)
 	// only for debugging:
 	// reader.Logger(log.New(os.Stdout, "SpoolRecordReader: ", 0))
 
-	closeHookCount := 0
-	reader.CloseHook = func(filepath string) {
-		closeHookCount++
-		filedir := path.Dir(filepath)
-		filename := path.Base(filepath)
-		newname := fmt.Sprintf("/indexed_%v.", time.Now().Unix())
-		filepathRename := filedir + newname + filename
-		err := os.Rename(filepath, filepathRename)
+	// rename, move, gzip or delete each file once it is indexed,
+	// then write the registry file:
+	reader.CloseHook = sensor.closeFile
+	sensor.done = ub.done
+	// records are decoded on several goroutines, see "beat/pipeline.go":
+	batch := NewBatch(ub.events, sensor.acker, sensor.batchSize, sensor.batchLatency)
+	sensor.pipeline = NewPipeline(sensor, batch, sensor.decodeWorkers, 2*sensor.batchSize)
+	// however this returns, publish what was read:
+	defer sensor.drain(ub.spoolTimeout)
+
+	// wake up on changes in the spool folder instead of polling it:
+	watcher, err := NewSpoolWatcher(sensor.Config.Spooler.Folder,
+		sensor.Config.Spooler.FilePrefix, sensor.Config.SpoolWatch, sensor.pollInterval)
+	if err != nil {
+		logp.Critical("U2SpoolAndPublish: %v unable to watch spool folder: '%v'", sensor, err)
+		return
+	}
+	defer watcher.Close()
+	reader.Watched = true
+	lastRescan := time.Now()
+
+	// use current registrar state, each file is found by
+	// its device, inode and fingerprint rather than its name:
+	reader.FileSource = sensor.registrar.State.Source
+	reader.FileOffset = sensor.registrar.State.Offset
+	reader.StartOffset = sensor.registrar.StartOffset
+
+	// or start from a point in time:
+	if !ub.since.IsZero() {
+		reader.StartOffset = nil
+		err := reader.SeekTime(uint32(ub.since.Unix()))
 		if err != nil {
-			logp.Info("unable to rename file '%v' to '%v' err: %v", filepath, filepathRename, err)
+			logp.Critical("U2SpoolAndPublish: %v unable to find records since %v: '%v'", sensor, ub.since, err)
 			return
 		}
-		logp.Info("Indexed file: '%v' renamed: '%v'", filepath, filepathRename)
+		logp.Info("U2SpoolAndPublish: %v starting at records since %v: file: '%v' offset: %v",
+			sensor, ub.since, reader.FileSource, reader.FileOffset)
+		sensor.skipSince(reader)
 	}
 
-	// use current registrar state:
-	reader.FileSource = ub.registrar.State.Source
-	reader.FileOffset = ub.registrar.State.Offset
-
 	var tot int
 	// forever index all files in the specifed spool folder:
-	for ub.isSpooling {
-		// select {
-		// case <-quit:
-		// 	logp.Info("U2SpoolAndPublish: told to quit; graceful return.")
-		// 	close(quit)
-		// 	return
-		// default:
+	for {
+		select {
+		case <-ub.done:
+			logp.Info("U2SpoolAndPublish: %v told to stop; graceful return.", sensor)
+			logp.Info("U2SpoolAndPublish: %v done after %v records.", sensor, tot)
+			return
+		default:
+		}
+		sensor.flushRegistry()
 		record, err := reader.Next()
+		if raw, ok := record.(*unified2.RawRecord); ok && err == unified2.DecodingError && sensor.Config.RawRecords {
+			// the record was read but not decoded, so index it raw:
+			record, err = sensor.undecodable(raw), nil
+		}
 		if err != nil {
-			if err == io.EOF {
+			switch {
+			case err == io.EOF:
 				// EOF is returned when the end of the last (most recent file)
 				// spool file is reached and there is nothing else to read.
 				// Note that "reader.Next()" only returns "io.EOF" when there
 				// are no other files to open ... in other words, it is
 				// always tailing the last file opened.
-				time.Sleep(time.Millisecond * 500)
-			} else {
-				logp.Critical("U2SpoolAndPublish: unexpected error: '%v'", err)
+				ub.waitForSpool(reader, watcher, &lastRescan)
+			case err == io.ErrUnexpectedEOF && !reader.HasNext():
+				// the sensor has only written part of a record so far
+				ub.waitForSpool(reader, watcher, &lastRescan)
+			case sensor.Config.Recovery.Enabled && isCorrupt(err):
+				// see "beat/recovery.go"
+				if rerr := sensor.recover(reader, err); rerr != nil {
+					logp.Critical("U2SpoolAndPublish: %v unable to recover from error: '%v' because: '%v'", sensor, err, rerr)
+					return
+				}
+			default:
+				logp.Critical("U2SpoolAndPublish: %v unexpected error: '%v'", sensor, err)
 				return
 			}
+			continue
 		}
 
 		if record == nil {
 			// The vars "record" and "err" are nil when there are no files
 			// at all to be read.  This will happen if the "reader.Next()"
 			// is called before any files exist in the folder being spooled.
-			time.Sleep(time.Millisecond * 500)
+			ub.waitForSpool(reader, watcher, &lastRescan)
 			// now, go see if a new record has appeared
 			continue
 		}
@@ -110,34 +160,35 @@ func (ub *Unifiedbeat) U2SpoolAndPublish() {
 		// at this point, we have read a unified2 record, which
 		// needs to be converted into JSON and indexed into ES
 		filename, offset := reader.Offset()
-
-		// update registrar:
-		ub.registrar.State.Source = filename
-		ub.registrar.State.Offset = offset
-		// should it WriteRegistry here ?
-		// that means lots of disk writes, but is
-		// the registry file info that important ?
-
-		tot++
-		sourceFullPath := path.Join(ub.UbConfig.Sensor.Spooler.Folder, filename)
-		event := &FileEvent{
-			ReadTime:     time.Now(),
-			Source:       sourceFullPath,
-			InputType:    "unified2",
-			DocumentType: "unified2", // this changes for each unified2 record type
-			Offset:       offset,
-			U2Record:     record,
-			Fields:       &ub.UbConfig.Sensor.Fields,
+		// see "beat/raw.go":
+		record = sensor.unknownRecord(filename, offset, record)
+		if record == nil {
+			continue
 		}
-		event.SetFieldsUnderRoot(ub.UbConfig.Sensor.FieldsUnderRoot)
-
-		eventCommonMapStr := event.ToMapStr() // see "beat/u2recordhandler.go"
-
-		ub.events.PublishEvent(eventCommonMapStr)
-
-		// } // end: select default
 
+		tot++
+		// the record is converted in the pipeline, and the registrar is
+		// updated once the output acknowledges its batch, the registry
+		// file is written every "registry_flush" seconds and whenever a
+		// file is closed:
+		sensor.pipeline.Submit(filename, offset, record)
 	} // end: forever index all files in the specifed spool folder
+}
 
-	logp.Info("U2SpoolAndPublish: done.")
+// waitForSpool blocks until the watcher reports a change in the spool
+// folder, the beat is stopped, or for at most spoolIdleWake so the
+// registry file is still written every "registry_flush" seconds.
+// The reader only re-reads the spool folder when files came or went,
+// or every spoolRescanInterval just in case the watcher missed one.
+func (ub *Unifiedbeat) waitForSpool(reader *unified2.SpoolRecordReader, watcher SpoolWatcher, lastRescan *time.Time) {
+	select {
+	case <-watcher.Changes():
+	case <-ub.done:
+		return
+	case <-time.After(spoolIdleWake):
+	}
+	if watcher.DirChanged() || time.Since(*lastRescan) > spoolRescanInterval {
+		reader.DirectoryChanged()
+		*lastRescan = time.Now()
+	}
 }
@@ -0,0 +1,127 @@
+/* Copyright (c) 2016 Chris Smith
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED ``AS IS'' AND ANY EXPRESS OR IMPLIED
+ * WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package unifiedbeat
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/cleesmith/go-unified2"
+)
+
+// writeSpoolFile writes an event record for each second to filename.
+func writeSpoolFile(t *testing.T, filename string, seconds ...uint32) {
+	var buf bytes.Buffer
+	for i, second := range seconds {
+		event := &unified2.EventRecord{SensorId: 1, EventId: uint32(i + 1), EventSecond: second,
+			GeneratorId: 1, SignatureId: 1000, SignatureRevision: 1,
+			IpSource: []byte{10, 0, 0, 1}, IpDestination: []byte{10, 0, 0, 2}}
+		raw, err := unified2.EncodeRecord(event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := unified2.WriteRawRecord(&buf, raw); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filename, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readSpool reads a spool folder the way U2SpoolAndPublish does after
+// a restart, from the registry, returning the time of each event read.
+func readSpool(t *testing.T, folder, registryFile string) []uint32 {
+	registrar, err := NewRegistrar(registryFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registrar.LoadState()
+	reader := unified2.NewSpoolRecordReader(folder, "snort.log")
+	reader.FileSource = registrar.State.Source
+	reader.FileOffset = registrar.State.Offset
+	reader.StartOffset = registrar.StartOffset
+	reader.CloseHook = func(filename string) {
+		// archived, so it is not read again:
+		os.Rename(filename, filepath.Join(folder, archivedPrefix+filepath.Base(filename)))
+	}
+	var seconds []uint32
+	for len(seconds) < 100 {
+		record, err := reader.Next()
+		if err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+		if record == nil {
+			break
+		}
+		if event, ok := record.(*unified2.EventRecord); ok {
+			seconds = append(seconds, event.EventSecond)
+		}
+	}
+	return seconds
+}
+
+// After -since a restart without it does not read the files skipped.
+func TestSkipSince(t *testing.T) {
+	folder, err := ioutil.TempDir("", "unifiedbeat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(folder)
+	registryFile := filepath.Join(folder, "registry")
+	spool := filepath.Join(folder, "spool")
+	if err := os.Mkdir(spool, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeSpoolFile(t, filepath.Join(spool, "snort.log.1"), 100, 200)
+	writeSpoolFile(t, filepath.Join(spool, "snort.log.2"), 300, 400)
+	writeSpoolFile(t, filepath.Join(spool, "snort.log.3"), 500, 600)
+
+	registrar, err := NewRegistrar(registryFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sensor := &Sensor{Name: "test", registrar: registrar}
+	reader := unified2.NewSpoolRecordReader(spool, "snort.log")
+	if err := reader.SeekTime(400); err != nil {
+		t.Fatal(err)
+	}
+	sensor.skipSince(reader)
+
+	if seconds, expected := readSpool(t, spool, registryFile), []uint32{400, 500, 600}; !reflect.DeepEqual(seconds, expected) {
+		t.Errorf("read events at %v after a restart, expected %v", seconds, expected)
+	}
+	// the skipped file was read past, so it is archived like the others:
+	if _, err := os.Stat(filepath.Join(spool, "snort.log.1")); !os.IsNotExist(err) {
+		t.Errorf("the skipped file is still in the spool: %v", err)
+	}
+}
@@ -0,0 +1,458 @@
+/* Copyright (c) 2016 Chris Smith
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED ``AS IS'' AND ANY EXPRESS OR IMPLIED
+ * WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// u2gen writes a synthetic stream of unified2 alerts, an event record
+// followed by its packet record and sometimes extra data, into a spool
+// folder the way Snort does, to test unifiedbeat without a sensor.
+//
+//	u2gen -dir /var/log/snort -prefix snort.log -rate 50 -rules "/etc/snort/rules/*.rules"
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/cleesmith/go-unified2"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Snort's extra data types and the blob data type
+const (
+	extraHttpUri      = 9
+	extraHttpHostname = 10
+	extraDataBlob     = 1
+)
+
+// signature is what an alert needs from a rule
+type signature struct {
+	gid, sid, rev, priority uint32
+	protocol                string // tcp, udp or icmp
+	dport                   uint16 // 0 for any
+}
+
+// rules from "sample_data/rules", used when no -rules are given
+var defaultSignatures = []signature{
+	{1, 1292, 9, 2, "tcp", 0},   // ATTACK-RESPONSES directory listing
+	{1, 494, 10, 1, "tcp", 0},   // ATTACK-RESPONSES command completed
+	{1, 2546, 5, 2, "tcp", 21},  // FTP MDTM overflow attempt
+	{1, 2374, 6, 2, "tcp", 21},  // FTP NLST overflow attempt
+	{1, 366, 7, 3, "icmp", 0},   // ICMP PING *NIX
+	{1, 718, 9, 2, "tcp", 0},    // INFO TELNET login incorrect
+	{1, 716, 13, 3, "tcp", 0},   // INFO TELNET access
+	{1, 488, 4, 2, "tcp", 80},   // INFO Connection Closed MSG from Port 80
+	{1, 553, 7, 3, "tcp", 21},   // POLICY FTP anonymous login attempt
+	{1, 560, 6, 2, "tcp", 0},    // POLICY VNC server response
+	{1, 2093, 5, 2, "tcp", 111}, // RPC portmap proxy integer overflow attempt TCP
+	{1, 2092, 5, 2, "udp", 111}, // RPC portmap proxy integer overflow attempt UDP
+	{1, 1893, 4, 2, "udp", 161}, // SNMP missing community string attempt
+	{1, 1892, 6, 2, "udp", 161}, // SNMP null community string attempt
+}
+
+var (
+	sidRegexp      = regexp.MustCompile(`sid:\s*(\d+)`)
+	gidRegexp      = regexp.MustCompile(`gid:\s*(\d+)`)
+	revRegexp      = regexp.MustCompile(`rev:\s*(\d+)`)
+	priorityRegexp = regexp.MustCompile(`priority:\s*(\d+)`)
+)
+
+func main() {
+	dir := flag.String("dir", ".", "spool folder to write unified2 files in")
+	prefix := flag.String("prefix", "snort.log", "unified2 file name prefix")
+	rate := flag.Float64("rate", 10, "alerts per second")
+	count := flag.Int("count", 0, "stop after this many alerts, 0 means never")
+	duration := flag.Duration("duration", 0, "stop after this long, 0 means never")
+	maxSize := flag.Int64("max-size", 128, "rotate files at this size in MB, like Snort's 'limit'")
+	sensorId := flag.Uint("sensor-id", 0, "sensor_id of the alerts")
+	ipv6 := flag.Float64("ipv6", 0.05, "fraction of alerts with IPv6 addresses")
+	extra := flag.Float64("extra-data", 0.2, "fraction of HTTP alerts with extra data (URI and hostname)")
+	burst := flag.Float64("burst", 0.1, "chance a signature repeats between the same hosts, like an alert storm")
+	rules := flag.String("rules", "", "glob of Snort rule files to take signatures from, e.g. \"/etc/snort/rules/*.rules\"")
+	seed := flag.Int64("seed", 0, "random seed, 0 means the current time")
+	flag.Parse()
+
+	if *rate <= 0 {
+		log.Fatal("u2gen: -rate must be greater than 0")
+	}
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	random := rand.New(rand.NewSource(*seed))
+
+	signatures := defaultSignatures
+	if *rules != "" {
+		var err error
+		signatures, err = loadSignatures(*rules)
+		if err != nil {
+			log.Fatalf("u2gen: %v", err)
+		}
+	}
+
+	writer := unified2.NewSpoolWriter(*dir, *prefix, *maxSize*1024*1024)
+	defer writer.Close()
+
+	g := &generator{
+		writer:     writer,
+		random:     random,
+		signatures: signatures,
+		sensorId:   uint32(*sensorId),
+		ipv6:       *ipv6,
+		extra:      *extra,
+		burst:      *burst,
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	var deadline <-chan time.Time
+	if *duration > 0 {
+		deadline = time.After(*duration)
+	}
+
+	// alerts are written in small batches, as many as the rate allows
+	// for the time that has passed, so high rates are possible:
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	started := time.Now()
+	for {
+		select {
+		case <-stop:
+			log.Printf("u2gen: stopped after %v alerts", g.alerts)
+			return
+		case <-deadline:
+			log.Printf("u2gen: wrote %v alerts in %v", g.alerts, *duration)
+			return
+		case <-ticker.C:
+		}
+		due := int(time.Since(started).Seconds() * *rate)
+		for g.alerts < due {
+			if err := g.alert(); err != nil {
+				log.Fatalf("u2gen: %v", err)
+			}
+			if *count > 0 && g.alerts >= *count {
+				log.Printf("u2gen: wrote %v alerts to '%v'", g.alerts, writer.Name())
+				return
+			}
+		}
+	}
+}
+
+// loadSignatures reads the gid, sid, rev, priority, protocol and
+// destination port of every active rule in the files matching pattern.
+func loadSignatures(pattern string) ([]signature, error) {
+	files, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	var signatures []signature
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			match := sidRegexp.FindStringSubmatch(line)
+			if match == nil {
+				continue
+			}
+			s := signature{gid: 1, rev: 1, priority: 2, sid: atoi(match[1])}
+			if match := gidRegexp.FindStringSubmatch(line); match != nil {
+				s.gid = atoi(match[1])
+			}
+			if match := revRegexp.FindStringSubmatch(line); match != nil {
+				s.rev = atoi(match[1])
+			}
+			if match := priorityRegexp.FindStringSubmatch(line); match != nil {
+				s.priority = atoi(match[1])
+			}
+			// e.g. "alert tcp $EXTERNAL_NET any -> $HOME_NET 80 (msg: ..."
+			header := strings.Fields(line)
+			if len(header) >= 7 {
+				s.protocol = header[1]
+				if port, err := strconv.ParseUint(header[6], 10, 16); err == nil {
+					s.dport = uint16(port)
+				}
+			}
+			signatures = append(signatures, s)
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	if len(signatures) == 0 {
+		return nil, fmt.Errorf("no rules found in '%v'", pattern)
+	}
+	return signatures, nil
+}
+
+func atoi(s string) uint32 {
+	n, _ := strconv.ParseUint(s, 10, 32)
+	return uint32(n)
+}
+
+// generator writes one alert at a time
+type generator struct {
+	writer     *unified2.SpoolWriter
+	random     *rand.Rand
+	signatures []signature
+	sensorId   uint32
+	ipv6       float64
+	extra      float64
+	burst      float64
+	alerts     int
+	eventId    uint32
+	last       *alert // repeated during a burst
+}
+
+// alert is the signature and hosts of an alert
+type alert struct {
+	signature
+	src, dst     net.IP
+	sport, dport uint16
+}
+
+func (g *generator) alert() error {
+	a := g.last
+	if a == nil || g.random.Float64() >= g.burst {
+		a = g.newAlert()
+		g.last = a
+	}
+	g.alerts++
+	g.eventId++
+	now := time.Now()
+
+	event := &unified2.EventRecord{
+		SensorId:          g.sensorId,
+		EventId:           g.eventId,
+		EventSecond:       uint32(now.Unix()),
+		EventMicrosecond:  uint32(now.Nanosecond() / 1000),
+		SignatureId:       a.sid,
+		GeneratorId:       a.gid,
+		SignatureRevision: a.rev,
+		ClassificationId:  uint32(g.random.Intn(38) + 1),
+		Priority:          a.priority,
+		IpSource:          a.src,
+		IpDestination:     a.dst,
+		SportItype:        a.sport,
+		DportIcode:        a.dport,
+		Protocol:          protocolNumber(a.protocol, a.src.To4() == nil),
+	}
+	if err := g.writer.WriteRecord(event); err != nil {
+		return err
+	}
+
+	frame, err := g.frame(a)
+	if err != nil {
+		return err
+	}
+	packet := &unified2.PacketRecord{
+		SensorId:          g.sensorId,
+		EventId:           g.eventId,
+		EventSecond:       event.EventSecond,
+		PacketSecond:      event.EventSecond,
+		PacketMicrosecond: event.EventMicrosecond,
+		LinkType:          1, // ethernet
+		Data:              frame,
+	}
+	if err := g.writer.WriteRecord(packet); err != nil {
+		return err
+	}
+
+	if a.protocol == "tcp" && a.dport == 80 && g.random.Float64() < g.extra {
+		for extraType, data := range map[uint32]string{
+			extraHttpUri:      "/index.php?id=" + strconv.Itoa(g.random.Intn(10000)),
+			extraHttpHostname: "www.example.com",
+		} {
+			err := g.writer.WriteRecord(&unified2.ExtraDataRecord{
+				SensorId:    g.sensorId,
+				EventId:     g.eventId,
+				EventSecond: event.EventSecond,
+				Type:        extraType,
+				DataType:    extraDataBlob,
+				Data:        []byte(data),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// newAlert picks a signature and a pair of hosts, sources are anywhere
+// and destinations are in a home network.
+func (g *generator) newAlert() *alert {
+	a := &alert{signature: g.signatures[g.random.Intn(len(g.signatures))]}
+	switch a.protocol {
+	case "tcp", "udp", "icmp":
+	default:
+		a.protocol = []string{"tcp", "tcp", "tcp", "udp", "icmp"}[g.random.Intn(5)]
+	}
+	if g.random.Float64() < g.ipv6 {
+		a.src = net.IP{0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, byte(g.random.Intn(256)),
+			0, 0, 0, 0, 0, 0, byte(g.random.Intn(256)), byte(g.random.Intn(256))}
+		a.dst = net.IP{0xfd, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, byte(g.random.Intn(254) + 1)}
+	} else {
+		a.src = net.IP{byte(g.random.Intn(223) + 1), byte(g.random.Intn(256)), byte(g.random.Intn(256)), byte(g.random.Intn(254) + 1)}
+		a.dst = net.IP{192, 168, byte(g.random.Intn(4)), byte(g.random.Intn(254) + 1)}
+	}
+	switch a.protocol {
+	case "icmp":
+		// an echo request, the icmp type and code are the event's ports:
+		a.sport, a.dport = 8, 0
+		if a.src.To4() == nil {
+			a.sport = layers.ICMPv6TypeEchoRequest
+		}
+	default:
+		a.sport = uint16(g.random.Intn(28232) + 32768)
+		a.dport = a.signature.dport
+		if a.dport == 0 {
+			a.dport = []uint16{80, 443, 53, 22, 25, 445, 3389}[g.random.Intn(7)]
+		}
+	}
+	return a
+}
+
+// frame builds the ethernet frame of an alert's packet.
+func (g *generator) frame(a *alert) ([]byte, error) {
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{0x00, 0x16, 0x3e, 0x01, 0x02, byte(g.random.Intn(256))},
+		DstMAC:       net.HardwareAddr{0x00, 0x16, 0x3e, 0x0a, 0x0b, 0x0c},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	var network gopacket.NetworkLayer
+	var ip gopacket.SerializableLayer
+	if a.src.To4() == nil {
+		eth.EthernetType = layers.EthernetTypeIPv6
+		ip6 := &layers.IPv6{Version: 6, HopLimit: 64, SrcIP: a.src, DstIP: a.dst}
+		network, ip = ip6, ip6
+		switch a.protocol {
+		case "tcp":
+			ip6.NextHeader = layers.IPProtocolTCP
+		case "udp":
+			ip6.NextHeader = layers.IPProtocolUDP
+		default:
+			ip6.NextHeader = layers.IPProtocolICMPv6
+		}
+	} else {
+		ip4 := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Id: uint16(g.random.Intn(65536)),
+			Flags: layers.IPv4DontFragment, SrcIP: a.src.To4(), DstIP: a.dst.To4()}
+		network, ip = ip4, ip4
+		switch a.protocol {
+		case "tcp":
+			ip4.Protocol = layers.IPProtocolTCP
+		case "udp":
+			ip4.Protocol = layers.IPProtocolUDP
+		default:
+			ip4.Protocol = layers.IPProtocolICMPv4
+		}
+	}
+
+	var transport gopacket.SerializableLayer
+	payload := gopacket.Payload(g.payload(a))
+	switch a.protocol {
+	case "tcp":
+		tcp := &layers.TCP{SrcPort: layers.TCPPort(a.sport), DstPort: layers.TCPPort(a.dport),
+			Seq: g.random.Uint32(), Ack: g.random.Uint32(), PSH: true, ACK: true, Window: 29200}
+		tcp.SetNetworkLayerForChecksum(network)
+		transport = tcp
+	case "udp":
+		udp := &layers.UDP{SrcPort: layers.UDPPort(a.sport), DstPort: layers.UDPPort(a.dport)}
+		udp.SetNetworkLayerForChecksum(network)
+		transport = udp
+	default:
+		// an echo request, then its id and sequence
+		if a.src.To4() == nil {
+			icmp6 := &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(uint8(a.sport), uint8(a.dport)),
+				TypeBytes: []byte{0, 1, 0, byte(g.random.Intn(256))}}
+			icmp6.SetNetworkLayerForChecksum(network)
+			transport = icmp6
+			break
+		}
+		// type 8, code 0, a checksum the sensor does not check
+		echo := []byte{8, 0, 0, 0, 0, 1, 0, byte(g.random.Intn(256))}
+		transport = gopacket.Payload(echo)
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	err := gopacket.SerializeLayers(buf, opts, eth, ip, transport, payload)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// payload is some typical application data for the destination port.
+func (g *generator) payload(a *alert) []byte {
+	switch a.dport {
+	case 80:
+		return []byte("GET /index.php?id=" + strconv.Itoa(g.random.Intn(10000)) + " HTTP/1.1\r\n" +
+			"Host: www.example.com\r\nUser-Agent: Mozilla/5.0\r\nAccept: */*\r\n\r\n")
+	case 25:
+		return []byte("MAIL FROM:<someone@example.com>\r\n")
+	case 22:
+		return []byte("SSH-2.0-libssh2_1.4.3\r\n")
+	case 53:
+		return []byte{0x12, 0x34, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+			7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0, 0x00, 0x01, 0x00, 0x01}
+	}
+	data := make([]byte, g.random.Intn(64)+16)
+	g.random.Read(data)
+	return data
+}
+
+// protocolNumber is the IP protocol number of a rule's protocol.
+func protocolNumber(protocol string, ipv6 bool) uint8 {
+	switch {
+	case protocol == "tcp":
+		return 6
+	case protocol == "udp":
+		return 17
+	case ipv6:
+		return 58 // icmpv6
+	}
+	return 1 // icmp
+}
@@ -0,0 +1,207 @@
+/* Copyright (c) 2016 Chris Smith
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED ``AS IS'' AND ANY EXPRESS OR IMPLIED
+ * WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/cleesmith/go-unified2"
+	"github.com/cleesmith/unifiedbeat/beat"
+)
+
+// dumpOptions are shared by dump and grep, which print records the
+// way unifiedbeat would index them
+type dumpOptions struct {
+	genMsgMap      string
+	rules          string
+	history        string
+	classification string
+	reference      string
+	geoip2         string
+	raw            bool
+	pretty         bool
+
+	ruleSet *unifiedbeat.RuleSet
+}
+
+func (o *dumpOptions) flags(flags *flag.FlagSet) {
+	flags.StringVar(&o.genMsgMap, "gen-msg-map", "", "Snort gen-msg.map file used to resolve signatures")
+	flags.StringVar(&o.rules, "rules", "", "Glob of Snort rule files used to resolve signatures")
+	flags.StringVar(&o.history, "rules-history", "", "Glob of older Snort rule files used to resolve the signatures of older rule revisions")
+	flags.StringVar(&o.classification, "classification", "", "Snort classification.config file used to name classifications")
+	flags.StringVar(&o.reference, "reference", "", "Snort reference.config file used to make URLs of rule references")
+	flags.StringVar(&o.geoip2, "geoip2", "", "GeoIP2 City database used to locate addresses")
+	flags.BoolVar(&o.raw, "raw", true, "Print unknown and undecodable records as \"raw\" documents")
+	flags.BoolVar(&o.pretty, "pretty", false, "Indent the JSON documents")
+}
+
+// load reads the rules, older rule revisions, classifications,
+// references and GeoIP2 database, if any were given.
+func (o *dumpOptions) load() error {
+	if o.genMsgMap != "" || o.rules != "" {
+		var paths []string
+		if o.rules != "" {
+			paths = []string{o.rules}
+		}
+		ruleSet, _, _, err := unifiedbeat.LoadRules(o.genMsgMap, paths)
+		if err != nil {
+			return err
+		}
+		o.ruleSet = ruleSet
+	}
+	if o.history != "" {
+		if o.ruleSet == nil {
+			o.ruleSet = unifiedbeat.NewRuleSet()
+		}
+		if _, err := o.ruleSet.LoadHistory([]string{o.history}); err != nil {
+			return err
+		}
+	}
+	if o.classification != "" {
+		if o.ruleSet == nil {
+			o.ruleSet = unifiedbeat.NewRuleSet()
+		}
+		if _, err := o.ruleSet.LoadClassifications(o.classification); err != nil {
+			return err
+		}
+	}
+	if o.reference != "" {
+		if o.ruleSet == nil {
+			o.ruleSet = unifiedbeat.NewRuleSet()
+		}
+		if _, err := o.ruleSet.LoadReferences(o.reference); err != nil {
+			return err
+		}
+	}
+	if o.geoip2 != "" {
+		if err := unifiedbeat.OpenGeoIp2DB(o.geoip2); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// document is a record as unifiedbeat would index it, or nil for an
+// unknown or undecodable record when those are not wanted.
+func (o *dumpOptions) document(file string, offset int64, record *unified2.RawRecord) interface{} {
+	var u2Record interface{}
+	decoded, err := unified2.DecodeRecord(record)
+	switch {
+	case err != nil:
+		u2Record = &unifiedbeat.UndecodedRecord{RawRecord: record, Reason: "decoding_error"}
+	case decoded == nil:
+		u2Record = &unifiedbeat.UndecodedRecord{RawRecord: record, Reason: "unknown_type"}
+	default:
+		u2Record = decoded
+	}
+	if _, undecoded := u2Record.(*unifiedbeat.UndecodedRecord); undecoded && !o.raw {
+		return nil
+	}
+	event := &unifiedbeat.FileEvent{
+		ReadTime:     time.Now(),
+		Source:       file,
+		InputType:    "unified2",
+		DocumentType: "unified2",
+		Offset:       offset,
+		U2Record:     u2Record,
+		RuleSet:      o.ruleSet,
+	}
+	return event.ToMapStr()
+}
+
+// printer writes documents as JSON lines.
+type printer struct {
+	out    *bufio.Writer
+	pretty bool
+}
+
+func newPrinter(pretty bool) *printer {
+	return &printer{bufio.NewWriter(os.Stdout), pretty}
+}
+
+func (p *printer) print(document interface{}) error {
+	var line []byte
+	var err error
+	if p.pretty {
+		line, err = json.MarshalIndent(document, "", "  ")
+	} else {
+		line, err = json.Marshal(document)
+	}
+	if err != nil {
+		return err
+	}
+	p.out.Write(line)
+	return p.out.WriteByte('\n')
+}
+
+func (p *printer) flush() error {
+	return p.out.Flush()
+}
+
+func dump(args []string) error {
+	var options dumpOptions
+	flags := flag.NewFlagSet("dump", flag.ExitOnError)
+	options.flags(flags)
+	limit := flags.Int("n", 0, "Stop after this many records, 0 for all")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: unified2 dump [options] file...\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if err := options.load(); err != nil {
+		return err
+	}
+
+	out := newPrinter(options.pretty)
+	count := 0
+	err := eachRecord(flags.Args(), func(file string, offset int64, record *unified2.RawRecord) error {
+		if *limit > 0 && count >= *limit {
+			return errDone
+		}
+		count++
+		if document := options.document(file, offset, record); document != nil {
+			return out.print(document)
+		}
+		return nil
+	})
+	if err == errDone {
+		err = nil
+	}
+	if ferr := out.flush(); err == nil {
+		err = ferr
+	}
+	return err
+}
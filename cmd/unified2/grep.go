@@ -0,0 +1,214 @@
+/* Copyright (c) 2016 Chris Smith
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED ``AS IS'' AND ANY EXPRESS OR IMPLIED
+ * WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/cleesmith/go-unified2"
+)
+
+// ipFlag is a flag.Value for an address or a CIDR network
+type ipFlag struct {
+	network *net.IPNet
+}
+
+func (f *ipFlag) String() string {
+	if f.network == nil {
+		return ""
+	}
+	return f.network.String()
+}
+
+func (f *ipFlag) Set(value string) error {
+	if !strings.Contains(value, "/") {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return fmt.Errorf("invalid address: '%v'", value)
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 8 * net.IPv4len
+		}
+		f.network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		return nil
+	}
+	_, network, err := net.ParseCIDR(value)
+	f.network = network
+	return err
+}
+
+func (f *ipFlag) matches(ip net.IP) bool {
+	return f.network.Contains(ip)
+}
+
+// eventFilter selects events, and the packet and extra data records
+// that belong to them.
+type eventFilter struct {
+	eventId  int64
+	sensorId int64
+	gid      int64
+	sid      int64
+	ip       ipFlag
+	since    timeFlag
+	until    timeFlag
+
+	matched map[eventKey]bool
+}
+
+func (f *eventFilter) flags(flags *flag.FlagSet) {
+	flags.Int64Var(&f.eventId, "event-id", -1, "Select events with this event_id")
+	flags.Int64Var(&f.sensorId, "sensor-id", -1, "Select events from this sensor_id")
+	flags.Int64Var(&f.gid, "gid", -1, "Select events with this generator id")
+	flags.Int64Var(&f.sid, "sid", -1, "Select events with this signature id")
+	flags.Var(&f.ip, "ip", "Select events with this source or destination address or network")
+	flags.Var(&f.since, "since", "Select records at or after this time, e.g. 2016-02-01T00:00Z")
+	flags.Var(&f.until, "until", "Select records before this time")
+}
+
+// byEvent is whether only event records can be tested, because the
+// filter looks at fields that packet and extra data records lack.
+func (f *eventFilter) byEvent() bool {
+	return f.gid >= 0 || f.sid >= 0 || f.ip.network != nil
+}
+
+func (f *eventFilter) timeMatches(second uint32) bool {
+	if !f.since.IsZero() && int64(second) < f.since.Unix() {
+		return false
+	}
+	if !f.until.IsZero() && int64(second) >= f.until.Unix() {
+		return false
+	}
+	return true
+}
+
+func (f *eventFilter) keyMatches(key eventKey) bool {
+	if f.eventId >= 0 && int64(key.eventId) != f.eventId {
+		return false
+	}
+	if f.sensorId >= 0 && int64(key.sensorId) != f.sensorId {
+		return false
+	}
+	return f.timeMatches(key.eventSecond)
+}
+
+// match tells whether a record is selected.  Packet and extra data
+// records follow the event they belong to.
+func (f *eventFilter) match(record *unified2.RawRecord) bool {
+	decoded, err := unified2.DecodeRecord(record)
+	var key eventKey
+	var ok bool
+	if err == nil && decoded != nil {
+		key, ok = keyOf(decoded)
+	}
+	if !ok {
+		// appstat, unknown or undecodable records are only selected by time:
+		if f.byEvent() || f.eventId >= 0 || f.sensorId >= 0 {
+			return false
+		}
+		second, _ := unified2.RecordSecond(record.Type, record.Data)
+		return f.timeMatches(second)
+	}
+	if appEvent, ok := decoded.(*unified2.AppIdEventRecord); ok {
+		decoded = &appEvent.EventRecord
+	}
+	event, isEvent := decoded.(*unified2.EventRecord)
+	if !isEvent {
+		return f.matched[key] || (!f.byEvent() && f.keyMatches(key))
+	}
+	selected := f.keyMatches(key) &&
+		(f.gid < 0 || int64(event.GeneratorId) == f.gid) &&
+		(f.sid < 0 || int64(event.SignatureId) == f.sid) &&
+		(f.ip.network == nil || f.ip.matches(event.IpSource) || f.ip.matches(event.IpDestination))
+	if selected {
+		f.matched[key] = true
+	}
+	return selected
+}
+
+func grep(args []string) error {
+	var options dumpOptions
+	filter := eventFilter{matched: make(map[eventKey]bool)}
+	flags := flag.NewFlagSet("grep", flag.ExitOnError)
+	options.flags(flags)
+	filter.flags(flags)
+	output := flags.String("o", "", "Write the selected records to this unified2 file instead of printing them")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: unified2 grep [options] file...\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		out := bufio.NewWriter(f)
+		err = eachRecord(flags.Args(), func(file string, offset int64, record *unified2.RawRecord) error {
+			if !filter.match(record) {
+				return nil
+			}
+			return unified2.WriteRawRecord(out, record)
+		})
+		if ferr := out.Flush(); err == nil {
+			err = ferr
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	}
+
+	if err := options.load(); err != nil {
+		return err
+	}
+	out := newPrinter(options.pretty)
+	err := eachRecord(flags.Args(), func(file string, offset int64, record *unified2.RawRecord) error {
+		if !filter.match(record) {
+			return nil
+		}
+		if document := options.document(file, offset, record); document != nil {
+			return out.print(document)
+		}
+		return nil
+	})
+	if ferr := out.flush(); err == nil {
+		err = ferr
+	}
+	return err
+}
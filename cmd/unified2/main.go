@@ -0,0 +1,198 @@
+/* Copyright (c) 2016 Chris Smith
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED ``AS IS'' AND ANY EXPRESS OR IMPLIED
+ * WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+// unified2 inspects and rewrites unified2 files:
+//
+//	unified2 dump   [options] file...   print records as JSON lines, as unifiedbeat indexes them
+//	unified2 stats  [options] file...   count records by type and gid:sid, and their time range
+//	unified2 grep   [options] file...   print (or write) the records of matching events
+//	unified2 split  [options] file...   rewrite records into files by time or by sensor
+//	unified2 merge  [options] file...   merge files into one, ordered by time
+//	unified2 verify [options] file...   check files for truncated or corrupt records
+//	unified2 pcap   [options] file...   write the packets of matching events to a pcap or pcapng file
+//
+// Files may be plain, gzip or bzip2 compressed, except for verify.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/cleesmith/go-unified2"
+)
+
+// errDone stops eachRecord early without an error
+var errDone = errors.New("done")
+
+// a subcommand is given its arguments, without its name
+type command struct {
+	run     func(args []string) error
+	summary string
+}
+
+var commands = map[string]command{
+	"dump":   {dump, "print records as JSON lines, as unifiedbeat indexes them"},
+	"stats":  {stats, "count records by type and gid:sid, and their time range"},
+	"grep":   {grep, "print (or write) the records of matching events"},
+	"split":  {split, "rewrite records into files by time or by sensor"},
+	"merge":  {merge, "merge files into one, ordered by time"},
+	"verify": {verify, "check files for truncated or corrupt records"},
+	"pcap":   {pcap, "write the packets of matching events to a pcap or pcapng file"},
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unified2: unknown command '%v'\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+	if err := cmd.run(os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "unified2 %v: %v\n", os.Args[1], err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: unified2 <command> [options] file...\n\ncommands:\n")
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-7v %v\n", name, commands[name].summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nuse \"unified2 <command> -h\" for the options of a command\n")
+}
+
+// openRecords opens a unified2 file, which may be gzip or bzip2
+// compressed, for reading records from.
+func openRecords(file string) (*unified2.StreamRecordReader, io.Closer, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	stream, err := unified2.Decompress(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return unified2.NewStreamRecordReader(stream), f, nil
+}
+
+// eachRecord calls fn with every raw record in the files, in order.
+func eachRecord(files []string, fn func(file string, offset int64, record *unified2.RawRecord) error) error {
+	for _, file := range files {
+		reader, closer, err := openRecords(file)
+		if err != nil {
+			return err
+		}
+		for {
+			record, err := reader.NextRaw()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				closer.Close()
+				return fmt.Errorf("'%v' at offset %v: %v", file, reader.Offset(), err)
+			}
+			if err := fn(file, reader.Offset(), record); err != nil {
+				closer.Close()
+				return err
+			}
+		}
+		closer.Close()
+	}
+	return nil
+}
+
+// recordNames are the names unifiedbeat gives the record types
+var recordNames = map[uint32]string{
+	unified2.UNIFIED2_PACKET:              "packet",
+	unified2.UNIFIED2_IDS_EVENT:           "event",
+	unified2.UNIFIED2_IDS_EVENT_IP6:       "event_ip6",
+	unified2.UNIFIED2_IDS_EVENT_V2:        "event_v2",
+	unified2.UNIFIED2_IDS_EVENT_IP6_V2:    "event_ip6_v2",
+	unified2.UNIFIED2_EXTRA_DATA:          "extradata",
+	unified2.UNIFIED2_IDS_EVENT_APPID:     "event_appid",
+	unified2.UNIFIED2_IDS_EVENT_APPID_IP6: "event_appid_ip6",
+	unified2.UNIFIED2_IDS_EVENT_APPSTAT:   "appstat",
+}
+
+func recordName(recordType uint32) string {
+	if name, ok := recordNames[recordType]; ok {
+		return name
+	}
+	return "unknown_" + strconv.FormatUint(uint64(recordType), 10)
+}
+
+// eventKey is what links an event with its packets and extra data.
+type eventKey struct {
+	sensorId, eventId, eventSecond uint32
+}
+
+// keyOf returns the eventKey of any decoded record that has one.
+func keyOf(record interface{}) (eventKey, bool) {
+	switch r := record.(type) {
+	case *unified2.EventRecord:
+		return eventKey{r.SensorId, r.EventId, r.EventSecond}, true
+	case *unified2.AppIdEventRecord:
+		return eventKey{r.SensorId, r.EventId, r.EventSecond}, true
+	case *unified2.PacketRecord:
+		return eventKey{r.SensorId, r.EventId, r.EventSecond}, true
+	case *unified2.ExtraDataRecord:
+		return eventKey{r.SensorId, r.EventId, r.EventSecond}, true
+	}
+	return eventKey{}, false
+}
+
+// timeFlag is a flag.Value for unified2.ParseTime
+type timeFlag struct {
+	time.Time
+}
+
+func (t *timeFlag) String() string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+func (t *timeFlag) Set(value string) error {
+	var err error
+	t.Time, err = unified2.ParseTime(value)
+	return err
+}
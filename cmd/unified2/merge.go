@@ -0,0 +1,121 @@
+/* Copyright (c) 2016 Chris Smith
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED ``AS IS'' AND ANY EXPRESS OR IMPLIED
+ * WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/cleesmith/go-unified2"
+)
+
+// mergeInput is the next record of one of the files being merged
+type mergeInput struct {
+	file   string
+	reader *unified2.StreamRecordReader
+	closer io.Closer
+	record *unified2.RawRecord
+	second uint32
+}
+
+// next reads the next record, which is nil at the end of the file.
+// A record without a time keeps the time of the one before it.
+func (in *mergeInput) next() error {
+	record, err := in.reader.NextRaw()
+	if err == io.EOF {
+		in.record = nil
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("'%v' at offset %v: %v", in.file, in.reader.Offset(), err)
+	}
+	in.record = record
+	if second, ok := recordTime(record); ok {
+		in.second = second
+	}
+	return nil
+}
+
+func merge(args []string) error {
+	flags := flag.NewFlagSet("merge", flag.ExitOnError)
+	output := flags.String("o", "", "The unified2 file written (required)")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: unified2 merge -o file [options] file...\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 || *output == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	var inputs []*mergeInput
+	defer func() {
+		for _, in := range inputs {
+			in.closer.Close()
+		}
+	}()
+	for _, file := range flags.Args() {
+		reader, closer, err := openRecords(file)
+		if err != nil {
+			return err
+		}
+		in := &mergeInput{file: file, reader: reader, closer: closer}
+		inputs = append(inputs, in)
+		if err := in.next(); err != nil {
+			return err
+		}
+	}
+
+	writer, err := createRecords(*output)
+	if err != nil {
+		return err
+	}
+	// always take the earliest record, on a tie the one from the file
+	// given first, so an event and its packets are never separated
+	for err == nil {
+		var earliest *mergeInput
+		for _, in := range inputs {
+			if in.record != nil && (earliest == nil || in.second < earliest.second) {
+				earliest = in
+			}
+		}
+		if earliest == nil {
+			break
+		}
+		err = writer.Write(earliest.record)
+		if err == nil {
+			err = earliest.next()
+		}
+	}
+	if cerr := writer.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,106 @@
+/* Copyright (c) 2016 Chris Smith
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED ``AS IS'' AND ANY EXPRESS OR IMPLIED
+ * WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/cleesmith/go-unified2"
+	"github.com/cleesmith/unifiedbeat/beat"
+)
+
+func pcap(args []string) error {
+	var options dumpOptions
+	filter := eventFilter{matched: make(map[eventKey]bool)}
+	flags := flag.NewFlagSet("pcap", flag.ExitOnError)
+	flags.StringVar(&options.genMsgMap, "gen-msg-map", "", "Snort gen-msg.map file used to resolve signatures")
+	flags.StringVar(&options.rules, "rules", "", "Glob of Snort rule files used to resolve signatures")
+	filter.flags(flags)
+	output := flags.String("o", "", "The pcap or pcapng file written (required), - for stdout")
+	format := flags.String("format", "", "pcap or pcapng, by default pcap for a .pcap file and otherwise pcapng")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: unified2 pcap -o file [options] file...\n")
+		fmt.Fprintf(os.Stderr, "pcapng packets have a comment with the gid:sid, signature and event_id of their event\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 || *output == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if *format == "" {
+		*format = "pcapng"
+		if filepath.Ext(*output) == ".pcap" {
+			*format = "pcap"
+		}
+	}
+	if err := options.load(); err != nil {
+		return err
+	}
+
+	file := os.Stdout
+	if *output != "-" {
+		var err error
+		if file, err = os.Create(*output); err != nil {
+			return err
+		}
+	}
+	out := bufio.NewWriter(file)
+	writer, err := unifiedbeat.NewPcapWriter(out, *format, options.ruleSet)
+	if err != nil {
+		return err
+	}
+	err = eachRecord(flags.Args(), func(filename string, offset int64, record *unified2.RawRecord) error {
+		if !filter.match(record) {
+			return nil
+		}
+		decoded, err := unified2.DecodeRecord(record)
+		if err != nil || decoded == nil {
+			return nil
+		}
+		return writer.Write(decoded)
+	})
+	if err == nil {
+		err = writer.Close()
+	}
+	if ferr := out.Flush(); err == nil {
+		err = ferr
+	}
+	if file != os.Stdout {
+		if cerr := file.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if writer.Skipped > 0 {
+		fmt.Fprintf(os.Stderr, "unified2 pcap: skipped %v packets of a different link type, use pcapng for them\n", writer.Skipped)
+	}
+	return err
+}
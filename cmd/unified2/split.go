@@ -0,0 +1,160 @@
+/* Copyright (c) 2016 Chris Smith
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED ``AS IS'' AND ANY EXPRESS OR IMPLIED
+ * WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/cleesmith/go-unified2"
+)
+
+// recordWriter writes raw records to a new unified2 file.
+type recordWriter struct {
+	file *os.File
+	out  *bufio.Writer
+}
+
+// createRecords creates a unified2 file, refusing to overwrite one.
+func createRecords(filename string) (*recordWriter, error) {
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &recordWriter{file, bufio.NewWriter(file)}, nil
+}
+
+func (w *recordWriter) Write(record *unified2.RawRecord) error {
+	return unified2.WriteRawRecord(w.out, record)
+}
+
+func (w *recordWriter) Close() error {
+	err := w.out.Flush()
+	if cerr := w.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// recordTime is when a record happened, for splitting and merging.
+// Packet and extra data records use the second of their event, so
+// they stay with it.  Records without a time return false.
+func recordTime(record *unified2.RawRecord) (uint32, bool) {
+	if decoded, err := unified2.DecodeRecord(record); err == nil && decoded != nil {
+		if key, ok := keyOf(decoded); ok {
+			return key.eventSecond, true
+		}
+	}
+	second, ok := unified2.RecordSecond(record.Type, record.Data)
+	return second, ok && second != 0
+}
+
+// recordSensor is the sensor_id of a record, if it has one.
+func recordSensor(record *unified2.RawRecord) (uint32, bool) {
+	if decoded, err := unified2.DecodeRecord(record); err == nil && decoded != nil {
+		if key, ok := keyOf(decoded); ok {
+			return key.sensorId, true
+		}
+	}
+	return 0, false
+}
+
+func split(args []string) error {
+	flags := flag.NewFlagSet("split", flag.ExitOnError)
+	by := flags.String("by", "time", "Split by \"time\" or by \"sensor\"")
+	interval := flags.Duration("interval", time.Hour, "Time covered by each file when splitting by time")
+	dir := flags.String("dir", ".", "Folder the files are written to, splitting by sensor uses a sub folder per sensor_id")
+	prefix := flags.String("prefix", "snort.log", "Prefix of the files written, followed by a unix timestamp")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: unified2 split [options] file...\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if *by != "time" && *by != "sensor" {
+		return fmt.Errorf("-by must be \"time\" or \"sensor\", not '%v'", *by)
+	}
+	bucketSeconds := uint32(interval.Seconds())
+	if bucketSeconds == 0 {
+		return fmt.Errorf("-interval must be at least one second")
+	}
+
+	// records without a time or sensor go where the one before went
+	writers := make(map[string]*recordWriter)
+	var name string
+	var last uint32
+	err := eachRecord(flags.Args(), func(file string, offset int64, record *unified2.RawRecord) error {
+		if second, ok := recordTime(record); ok {
+			last = second
+		}
+		switch *by {
+		case "time":
+			name = filepath.Join(*dir, fmt.Sprintf("%v.%v", *prefix, last-last%bucketSeconds))
+		case "sensor":
+			if sensorId, ok := recordSensor(record); ok || name == "" {
+				name = filepath.Join(*dir, fmt.Sprint(sensorId))
+			}
+		}
+		writer, ok := writers[name]
+		if !ok {
+			filename := name
+			if *by == "sensor" {
+				filename = filepath.Join(name, fmt.Sprintf("%v.%v", *prefix, last))
+			}
+			var err error
+			writer, err = createRecords(filename)
+			if err != nil {
+				return err
+			}
+			writers[name] = writer
+		}
+		return writer.Write(record)
+	})
+	var written []string
+	for _, writer := range writers {
+		if cerr := writer.Close(); err == nil {
+			err = cerr
+		}
+		written = append(written, writer.file.Name())
+	}
+	sort.Strings(written)
+	for _, filename := range written {
+		fmt.Println(filename)
+	}
+	return err
+}
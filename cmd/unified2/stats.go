@@ -0,0 +1,145 @@
+/* Copyright (c) 2016 Chris Smith
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED ``AS IS'' AND ANY EXPRESS OR IMPLIED
+ * WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/cleesmith/go-unified2"
+)
+
+// a count of something, for sorting
+type counted struct {
+	name  string
+	count int
+}
+
+type byCount []counted
+
+func (c byCount) Len() int      { return len(c) }
+func (c byCount) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+func (c byCount) Less(i, j int) bool {
+	if c[i].count != c[j].count {
+		return c[i].count > c[j].count
+	}
+	return c[i].name < c[j].name
+}
+
+func sortCounts(counts map[string]int) []counted {
+	var sorted []counted
+	for name, count := range counts {
+		sorted = append(sorted, counted{name, count})
+	}
+	sort.Sort(byCount(sorted))
+	return sorted
+}
+
+func stats(args []string) error {
+	flags := flag.NewFlagSet("stats", flag.ExitOnError)
+	top := flags.Int("top", 20, "Number of gid:sids listed, 0 for all")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: unified2 stats [options] file...\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	var records, bytes int64
+	var first, last uint32
+	types := make(map[string]int)
+	signatures := make(map[string]int)
+	sensors := make(map[uint32]int)
+	err := eachRecord(flags.Args(), func(file string, offset int64, record *unified2.RawRecord) error {
+		records++
+		bytes += unified2.RAW_HEADER_LEN + int64(len(record.Data))
+		types[recordName(record.Type)]++
+		if second, ok := unified2.RecordSecond(record.Type, record.Data); ok && second != 0 {
+			if first == 0 || second < first {
+				first = second
+			}
+			if second > last {
+				last = second
+			}
+		}
+		decoded, err := unified2.DecodeRecord(record)
+		if err != nil {
+			types["decoding_error"]++
+			return nil
+		}
+		if appEvent, ok := decoded.(*unified2.AppIdEventRecord); ok {
+			decoded = &appEvent.EventRecord
+		}
+		if event, ok := decoded.(*unified2.EventRecord); ok {
+			signatures[fmt.Sprintf("%v:%v", event.GeneratorId, event.SignatureId)]++
+			sensors[event.SensorId]++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("records: %v (%v bytes)\n", records, bytes)
+	if first != 0 {
+		from := time.Unix(int64(first), 0).UTC()
+		to := time.Unix(int64(last), 0).UTC()
+		fmt.Printf("time range: %v to %v (%v)\n", from.Format(time.RFC3339), to.Format(time.RFC3339), to.Sub(from))
+	}
+	fmt.Printf("\nrecord types:\n")
+	for _, c := range sortCounts(types) {
+		fmt.Printf("  %-16v %v\n", c.name, c.count)
+	}
+	if len(sensors) > 0 {
+		fmt.Printf("\nevents by sensor_id:\n")
+		var ids []int
+		for id := range sensors {
+			ids = append(ids, int(id))
+		}
+		sort.Ints(ids)
+		for _, id := range ids {
+			fmt.Printf("  %-16v %v\n", id, sensors[uint32(id)])
+		}
+	}
+	if len(signatures) > 0 {
+		fmt.Printf("\nevents by gid:sid (%v distinct):\n", len(signatures))
+		for i, c := range sortCounts(signatures) {
+			if *top > 0 && i >= *top {
+				fmt.Printf("  ...\n")
+				break
+			}
+			fmt.Printf("  %-16v %v\n", c.name, c.count)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+/* Copyright (c) 2016 Chris Smith
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED ``AS IS'' AND ANY EXPRESS OR IMPLIED
+ * WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+ * DISCLAIMED. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR ANY DIRECT,
+ * INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL DAMAGES
+ * (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+ * SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT,
+ * STRICT LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING
+ * IN ANY WAY OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE
+ * POSSIBILITY OF SUCH DAMAGE.
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/cleesmith/go-unified2"
+)
+
+// errProblems is returned by verify when any file has a problem, the
+// problems themselves have been printed already
+var errProblems = errors.New("problems were found")
+
+// a fileReport is what verify found in one file
+type fileReport struct {
+	records  int
+	unknown  int
+	problems int
+	skipped  int64
+}
+
+func verify(args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	quiet := flags.Bool("q", false, "Only print problems")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: unified2 verify [options] file...\n")
+		fmt.Fprintf(os.Stderr, "files must not be compressed, the exit status is 1 if any have problems\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	failed := false
+	for _, filename := range flags.Args() {
+		report, err := verifyFile(filename)
+		if err != nil {
+			return err
+		}
+		if report.problems > 0 {
+			failed = true
+			fmt.Printf("%v: %v problems, %v records, %v unknown records, %v bytes skipped\n",
+				filename, report.problems, report.records, report.unknown, report.skipped)
+		} else if !*quiet {
+			fmt.Printf("%v: ok, %v records, %v unknown records\n", filename, report.records, report.unknown)
+		}
+	}
+	if failed {
+		return errProblems
+	}
+	return nil
+}
+
+// verifyFile walks the record headers of a file, decoding each record,
+// and prints each problem found.  After a corrupt record it carries on
+// from the next plausible header, as unifiedbeat's recovery would.
+func verifyFile(filename string) (fileReport, error) {
+	var report fileReport
+	file, err := os.Open(filename)
+	if err != nil {
+		return report, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return report, err
+	}
+	size := info.Size()
+
+	problem := func(offset int64, format string, v ...interface{}) {
+		report.problems++
+		fmt.Printf("%v: offset %v: %v\n", filename, offset, fmt.Sprintf(format, v...))
+	}
+
+	var offset int64
+	for offset < size {
+		if _, err := file.Seek(offset, 0); err != nil {
+			return report, err
+		}
+		if size-offset < unified2.RAW_HEADER_LEN {
+			problem(offset, "truncated record header, %v bytes", size-offset)
+			break
+		}
+		var header unified2.RawHeader
+		if err := binary.Read(file, binary.BigEndian, &header); err != nil {
+			return report, err
+		}
+		next := offset + unified2.RAW_HEADER_LEN + int64(header.Len)
+
+		if !unified2.PlausibleHeader(header.Type, header.Len) {
+			// an unknown record type is fine if a record follows it:
+			_, known := recordNames[header.Type]
+			if !known && header.Len <= unified2.MAX_RECORD_LEN && (next == size || (next < size && headerAt(file, next))) {
+				report.unknown++
+				offset = next
+				continue
+			}
+			resynced, err := unified2.Resync(file, offset+1)
+			if err != nil && err != io.EOF {
+				return report, err
+			}
+			problem(offset, "corrupt record header (type %v, length %v), skipped %v bytes", header.Type, header.Len, resynced-offset)
+			report.skipped += resynced - offset
+			offset = resynced
+			continue
+		}
+		if next > size {
+			problem(offset, "truncated %v record, %v of %v bytes", recordName(header.Type), size-offset-unified2.RAW_HEADER_LEN, header.Len)
+			break
+		}
+
+		data := make([]byte, header.Len)
+		if _, err := io.ReadFull(file, data); err != nil {
+			return report, err
+		}
+		if _, err := unified2.DecodeRecord(&unified2.RawRecord{Type: header.Type, Data: data}); err != nil {
+			problem(offset, "%v record does not decode: %v", recordName(header.Type), err)
+		}
+		report.records++
+		offset = next
+	}
+	return report, nil
+}
+
+// headerAt tells whether a plausible record header is at offset.
+func headerAt(file io.ReadSeeker, offset int64) bool {
+	var header unified2.RawHeader
+	if _, err := file.Seek(offset, 0); err != nil {
+		return false
+	}
+	if err := binary.Read(file, binary.BigEndian, &header); err != nil {
+		return false
+	}
+	return unified2.PlausibleHeader(header.Type, header.Len)
+}